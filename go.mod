@@ -5,12 +5,12 @@ go 1.25.0
 require (
 	github.com/roidaradal/fn v0.5.52
 	github.com/schollz/progressbar/v3 v3.19.0
+	golang.org/x/sys v0.38.0
 )
 
 require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/term v0.28.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
 )
@@ -1,82 +1,167 @@
 package dali
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/roidaradal/fn/io"
+	"github.com/roidaradal/fn/list"
 	"github.com/roidaradal/fn/str"
 )
 
 const (
-	cfgPath        string = ".dali" // Full path: ~HOME/.dali
-	defaultTimeout int    = 3       // Default timeout: 3s
-	minTimeout     int    = 1       // Minimum timeout: 1s
-	discoveryPort  int    = 45678   // UDP discovery port
-	transferPort   uint16 = 45679   // TCP transfer port
+	cfgPath              string = ".dali" // Full path: ~HOME/.dali
+	defaultTimeout       int    = 3       // Default timeout: 3s
+	minTimeout           int    = 1       // Minimum timeout: 1s
+	defaultDiscoveryPort int    = 45678   // UDP discovery port
+	defaultTransferPort  uint16 = 45679   // TCP transfer port
+	maxPortFallback      int    = 10      // Number of ports to try for transfer listener
 )
 
-// Timestamp, Type, Result, FilePath, FileSize, SenderName, ReceiverName
-type Event [7]string
-
-// User's configuration (name, timeout, logs)
+// User's configuration (identity, name, timeout, address book, contacts, log settings)
 type Config struct {
-	Path    string `json:"-"`
-	Name    string
-	Timeout int
-	Logs    []Event
+	mu        sync.RWMutex // guards config mutations from concurrent transfers
+	Path      string       `json:"-"`
+	ID        string
+	Key       string
+	Name      string
+	Timeout   int
+	Ports     Ports
+	Allow     []string // subnets (CIDR) allowed to query discovery, empty = all
+	Token     string   `json:",omitempty"` // shared token for finding hidden peers
+	Peers     []Peer   // static peers (address book)
+	Contacts  map[string]Contact
+	LogPolicy *LogPolicy // nil if unset (configs created before event log)
+	Logs      []Event    `json:",omitempty"` // legacy logs (dali v0.1.4 and older), moved to event log
+}
+
+// Discovery (UDP) and transfer (TCP) ports
+type Ports struct {
+	Discovery int
+	Transfer  uint16
 }
 
 // Representation of machine
 type Node struct {
 	*Config
-	Addr string
+	Addr   string
+	Events *EventLog
 }
 
 // Create new Config
 func newConfig(name string) *Config {
 	return &Config{
-		Name:    name,
-		Timeout: defaultTimeout,
-		Logs:    []Event{},
+		Name:      name,
+		Timeout:   defaultTimeout,
+		Ports:     Ports{Discovery: defaultDiscoveryPort, Transfer: defaultTransferPort},
+		Peers:     []Peer{},
+		Contacts:  make(map[string]Contact),
+		LogPolicy: &LogPolicy{MaxSize: defaultLogMaxSize, MaxFiles: defaultLogMaxFiles},
+	}
+}
+
+// Use default ports for unset ports (configs created before custom ports)
+func (c *Config) InitPorts() {
+	if c.Ports.Discovery <= 0 {
+		c.Ports.Discovery = defaultDiscoveryPort
+	}
+	if c.Ports.Transfer == 0 {
+		c.Ports.Transfer = defaultTransferPort
+	}
+}
+
+// Use default log policy if unset (configs created before event log)
+func (c *Config) InitLogPolicy() {
+	if c.LogPolicy == nil {
+		c.LogPolicy = &LogPolicy{MaxSize: defaultLogMaxSize, MaxFiles: defaultLogMaxFiles}
 	}
 }
 
-// Add event log to config
-func (c *Config) AddLog(event Event) {
-	c.Logs = append(c.Logs, event)
+// Add static peer to address book, replacing peer with same name
+func (c *Config) AddPeer(name, addr string) {
+	c.RemovePeer(name)
+	c.Peers = append(c.Peers, Peer{Name: name, Addr: addr})
+}
+
+// Remove static peer from address book, returns true if peer was found
+func (c *Config) RemovePeer(name string) bool {
+	count := len(c.Peers)
+	c.Peers = list.Filter(c.Peers, func(p Peer) bool {
+		return !strings.EqualFold(p.Name, name)
+	})
+	return len(c.Peers) < count
 }
 
-// Save the config to file
+// Save the config to file, atomically and under file lock
 func (c *Config) Save() error {
-	// Save config file
-	return io.SaveJSON(c, c.Path)
+	c.mu.RLock()
+	data, err := json.Marshal(c)
+	c.mu.RUnlock()
+	if err != nil {
+		return wrapErr("failed to encode config", err)
+	}
+	return withFileLock(c.Path, func() error {
+		return writeFileAtomic(c.Path, data)
+	})
 }
 
-// Event indexes
-const (
-	evTimestamp int = 0
-	evType      int = 1
-	evResult    int = 2
-	evPath      int = 3
-	evSize      int = 4
-	evSender    int = 5
-	evReceiver  int = 6
-)
+// Apply mutation to config and save it. The config file is reloaded under file lock
+// before applying the mutation, so changes saved by other dali processes are kept.
+// The config is only changed in memory if the mutation was saved
+func (c *Config) Update(mutate func(cfg *Config) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return withFileLock(c.Path, func() error {
+		saved, err := io.ReadJSON[Config](c.Path)
+		if err != nil {
+			return wrapErr("failed to load dali config", err)
+		}
+		saved.InitLogPolicy() // log settings can be changed by the mutation
+		if err = mutate(saved); err != nil {
+			return err
+		}
+		data, err := json.Marshal(saved)
+		if err != nil {
+			return wrapErr("failed to encode config", err)
+		}
+		if err = writeFileAtomic(c.Path, data); err != nil {
+			return err
+		}
+		c.replaceWith(saved)
+		return nil
+	})
+}
+
+// Replace saved fields of config with those of saved config (caller holds the lock)
+func (c *Config) replaceWith(saved *Config) {
+	c.ID, c.Key, c.Name, c.Timeout = saved.ID, saved.Key, saved.Name, saved.Timeout
+	c.Ports, c.Allow, c.Token = saved.Ports, saved.Allow, saved.Token
+	c.Peers, c.Contacts = saved.Peers, saved.Contacts
+	c.LogPolicy, c.Logs = saved.LogPolicy, saved.Logs
+	c.InitPorts()
+	c.InitLogPolicy()
+}
 
-// Destructure event parts
-func (e Event) Tuple() (timestamp, eventType, result, filePath, fileSize, senderName, receiverName string) {
-	return e[evTimestamp], e[evType], e[evResult], e[evPath], e[evSize], e[evSender], e[evReceiver]
+// Get known contacts (safe to read: contacts map is replaced, not modified, on update)
+func (c *Config) KnownContacts() map[string]Contact {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Contacts
 }
 
-// String representationof Node
+// String representation of Node
 func (n Node) String() string {
+	self := n.Identity()
 	divider := strings.Repeat("=====", 5)
 	out := []string{
 		divider,
-		fmt.Sprintf("Name: %s", str.Green(n.Name)),
+		fmt.Sprintf("Name: %s", str.Green(self.Name)),
+		fmt.Sprintf("ID  : %s", str.Cyan(self.ID)),
 		fmt.Sprintf("Addr: %s", str.Yellow(n.Addr)),
 		fmt.Sprintf("Wait: %s", str.Red(str.Int(n.Timeout))),
+		fmt.Sprintf("Port: %s", str.Violet(fmt.Sprintf("%d (transfer), %d (discovery)", n.Ports.Transfer, n.Ports.Discovery))),
 		divider,
 	}
 	return strings.Join(out, "\n")
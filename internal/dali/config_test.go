@@ -0,0 +1,171 @@
+package dali
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/roidaradal/fn/io"
+)
+
+// Create node with config and event log in a temp folder
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := newConfig("alice")
+	cfg.Path = filepath.Join(dir, cfgPath)
+	if _, err := cfg.InitIdentity(); err != nil {
+		t.Fatalf("failed to create identity: %v", err)
+	}
+	if err := cfg.Save(); err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+	return &Node{
+		Config: cfg,
+		Addr:   "127.0.0.1",
+		Events: &EventLog{Path: filepath.Join(dir, logsPath), Policy: *cfg.LogPolicy},
+	}
+}
+
+// Simulates parallel transfers: each saves a contact, appends a log and updates the address book,
+// while others read contacts. Run with -race
+func TestConcurrentTransfers(t *testing.T) {
+	node := newTestNode(t)
+	self := node.Identity()
+	receiver := EventPeer{Name: self.Name, ID: self.ID, Addr: "127.0.0.1:45679"}
+
+	const numTransfers = 32
+	var wg sync.WaitGroup
+	for i := range numTransfers {
+		wg.Go(func() {
+			id, name := fmt.Sprintf("%016x", i+1), fmt.Sprintf("peer%d", i)
+			saveContact(node, id, name, fmt.Sprintf("10.0.0.%d:45679", i+1), "")
+			sender := EventPeer{Name: name, ID: id, Addr: fmt.Sprintf("10.0.0.%d:50000", i+1)}
+			event := newEvent(actionReceive, fmt.Sprintf("/tmp/file%d.txt", i), uint64(i), sender, receiver)
+			addLog(node, event, resultOK, nil)
+			err := node.Update(func(cfg *Config) error {
+				cfg.AddPeer(fmt.Sprintf("static%d", i), fmt.Sprintf("10.1.0.%d:45679", i+1))
+				return nil
+			})
+			if err != nil {
+				t.Errorf("failed to update config: %v", err)
+			}
+			node.KnownContacts()
+			node.ContactIDs(name)
+			// Identity is read by announces, queries and transfer responses during updates
+			nodeAnnounce(node, 45679)
+			nodeQuery(node, "")
+			response := offerTransfer(t, node, receiveOptions{}, newTextMessage(id, name, "hello"))
+			if response.Type != acceptType || response.SenderID != self.ID {
+				t.Errorf("unexpected response to message: %s from %s", response.Type, response.SenderID)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Updates are kept in memory and in the saved config
+	saved, err := io.ReadJSON[Config](node.Path)
+	if err != nil {
+		t.Fatalf("saved config is corrupted: %v", err)
+	}
+	for label, cfg := range map[string]*Config{"memory": node.Config, "saved": saved} {
+		if len(cfg.Contacts) != numTransfers || len(cfg.Peers) != numTransfers {
+			t.Errorf("%s config: expected %d contacts and peers, got %d and %d", label, numTransfers, len(cfg.Contacts), len(cfg.Peers))
+		}
+		if cfg.ID != node.ID || cfg.Name != "alice" {
+			t.Errorf("%s config: identity changed to %s (%s)", label, cfg.Name, cfg.ID)
+		}
+	}
+
+	// Every event is logged once, with no corrupted lines
+	events, err := node.Events.ReadAll()
+	if err != nil {
+		t.Fatalf("event log is corrupted: %v", err)
+	}
+	paths, messages := make(map[string]bool), 0
+	for _, event := range events {
+		if event.Kind == kindMessage {
+			messages += 1
+		} else {
+			paths[event.Path] = true
+		}
+	}
+	if len(events) != 2*numTransfers || len(paths) != numTransfers || messages != numTransfers {
+		t.Fatalf("expected %d distinct events and %d messages, got %d events (%d distinct, %d messages)", numTransfers, numTransfers, len(events), len(paths), messages)
+	}
+}
+
+func TestUpdateFailureKeepsConfig(t *testing.T) {
+	node := newTestNode(t)
+	node.AddPeer("bob", "10.0.0.2:45679")
+	if err := node.Save(); err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+
+	// Another process removes the peer
+	other, err := io.ReadJSON[Config](node.Path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	other.Path = node.Path
+	if err = other.Update(func(cfg *Config) error {
+		cfg.RemovePeer("bob")
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+
+	errNotFound := errors.New("not found")
+	err = node.Update(func(cfg *Config) error {
+		cfg.Name = "changed"
+		if !cfg.RemovePeer("bob") {
+			return errNotFound
+		}
+		return nil
+	})
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("expected %v, got %v", errNotFound, err)
+	}
+	if node.Name != "alice" || len(node.Peers) != 1 {
+		t.Fatalf("failed update changed config in memory: name=%s peers=%v", node.Name, node.Peers)
+	}
+}
+
+func TestLogPolicyUnset(t *testing.T) {
+	node := newTestNode(t)
+	// Unlimited logs (logsize=0 logfiles=0) are kept after reload
+	if err := node.Update(func(cfg *Config) error {
+		cfg.LogPolicy.MaxSize, cfg.LogPolicy.MaxFiles = 0, 0
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+	saved, err := io.ReadJSON[Config](node.Path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	saved.InitLogPolicy()
+	if *saved.LogPolicy != (LogPolicy{}) || *node.LogPolicy != (LogPolicy{}) {
+		t.Fatalf("expected unlimited log policy, got %+v (saved %+v)", *node.LogPolicy, *saved.LogPolicy)
+	}
+
+	// Configs created before event log get the default policy, also when updated
+	legacy := filepath.Join(t.TempDir(), cfgPath)
+	if err = os.WriteFile(legacy, []byte(`{"ID":"abc","Name":"bob","Timeout":3}`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg := &Config{Path: legacy}
+	if err = cfg.Update(func(cfg *Config) error {
+		cfg.LogPolicy.MaxEntries = 10
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update config: %v", err)
+	}
+	want := LogPolicy{MaxSize: defaultLogMaxSize, MaxFiles: defaultLogMaxFiles, MaxEntries: 10}
+	if *cfg.LogPolicy != want {
+		t.Fatalf("expected %+v, got %+v", want, *cfg.LogPolicy)
+	}
+}
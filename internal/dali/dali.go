@@ -3,15 +3,16 @@ package dali
 
 import (
 	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
-	"regexp"
 	"slices"
 	"strings"
 	"time"
 
-	"github.com/roidaradal/fn/clock"
 	"github.com/roidaradal/fn/dict"
 	"github.com/roidaradal/fn/io"
 	"github.com/roidaradal/fn/lang"
@@ -30,6 +31,11 @@ const (
 	updateCmd  string = "update"
 	logsCmd    string = "logs"
 	resetCmd   string = "reset"
+	peersCmd   string = "peers"
+	relayCmd   string = "relay"
+	statsCmd   string = "stats"
+	resendCmd  string = "resend"
+	msgCmd     string = "msg"
 )
 
 var CmdHandlers = map[string]func(*Node, dict.StringMap) error{
@@ -42,10 +48,15 @@ var CmdHandlers = map[string]func(*Node, dict.StringMap) error{
 	updateCmd:  cmdUpdate,
 	logsCmd:    cmdLogs,
 	resetCmd:   cmdReset,
+	peersCmd:   cmdPeers,
+	relayCmd:   cmdRelay,
+	statsCmd:   cmdStats,
+	resendCmd:  cmdResend,
+	msgCmd:     cmdMsg,
 }
 
 // List of commands, ordered for help
-var commands = []string{setCmd, openCmd, sendCmd, findCmd, updateCmd, logsCmd, resetCmd, versionCmd, HelpCmd}
+var commands = []string{setCmd, openCmd, sendCmd, resendCmd, msgCmd, findCmd, peersCmd, relayCmd, updateCmd, logsCmd, statsCmd, resetCmd, versionCmd, HelpCmd}
 
 var cmdColor = map[string]func(string) string{
 	HelpCmd:    str.Green,
@@ -57,6 +68,11 @@ var cmdColor = map[string]func(string) string{
 	updateCmd:  str.Blue,
 	logsCmd:    str.Violet,
 	resetCmd:   str.Red,
+	peersCmd:   str.Blue,
+	relayCmd:   str.Cyan,
+	statsCmd:   str.Violet,
+	resendCmd:  str.Green,
+	msgCmd:     str.Cyan,
 }
 
 var cmdSoloIP = map[string]bool{
@@ -66,21 +82,31 @@ var cmdSoloIP = map[string]bool{
 	updateCmd:  false,
 	logsCmd:    false,
 	resetCmd:   false,
+	peersCmd:   false,
+	relayCmd:   false,
+	statsCmd:   false,
 	findCmd:    true,
 	openCmd:    true,
 	sendCmd:    true,
+	resendCmd:  true,
+	msgCmd:     true,
 }
 
 var cmdText = dict.StringMap{
 	HelpCmd:    "display help message",
 	versionCmd: "display current version",
-	setCmd:     "update name and waiting time",
+	setCmd:     "update name, waiting time, and ports",
 	findCmd:    "discover open machines on local network",
 	openCmd:    "opens the machine to receive files and discovery",
 	sendCmd:    "send file to an open machine",
 	updateCmd:  "update dali to latest (or specific) version",
 	logsCmd:    "view activity logs",
 	resetCmd:   "erase name, timeout, logs",
+	peersCmd:   "manage address book of static peers",
+	relayCmd:   "bridge discovery between network interfaces (subnets)",
+	statsCmd:   "view transfer statistics from activity logs",
+	resendCmd:  "resend file from send log to the same receiver",
+	msgCmd:     "send text message to an open machine",
 }
 
 var cmdOptions = map[string][][2]string{
@@ -88,27 +114,74 @@ var cmdOptions = map[string][][2]string{
 		{"name={NAME}", "set your name (no spaces)"},
 		{"wait={TIMEOUT_SECS}", "set waiting time (in seconds) for finding peers"},
 		{"timeout={TIMEOUT_SECS}", "set waiting time (in seconds) for finding peers"},
+		{"port={PORT}", "set default transfer port (TCP)"},
+		{"discovery={PORT}", "set default discovery port (UDP)"},
+		{"allow={CIDR,...}", "only answer discovery queries from these subnets (empty = all)"},
+		{"token={TOKEN}", "set shared token for finding hidden peers"},
+		{"logsize={SIZE}", "rotate log file when it reaches size (e.g. 1MB, 0 = never)"},
+		{"logfiles={N}", "number of rotated log files to keep"},
+		{"logentries={N}", "keep only the newest {N} logs (0 = all)"},
+		{"logage={AGE}", "delete logs older than age, e.g. 90d (0 = never)"},
 	},
 	openCmd: {
 		{"", "listen on default port (45679)"},
-		{"port={PORT}", "listen on custom port"},
+		{"port={PORT}", "listen on custom port (tries next ports if unavailable)"},
+		{"discovery={PORT}", "listen for discovery queries on custom port"},
 		{"out={OUT_DIR}", "set custom output folder"},
 		{"output={OUT_DIR}", "set custom output folder"},
 		{"accept=auto", "auto-accepts incoming file transfers"},
-		{"overwrite", "overwrite old file path if it exists"},
+		{"overwrite", "overwrite old file path if it exists (default choice at the accept prompt)"},
+		{"noperms", "ignore file permissions sent by peer"},
+		{"stdout", "write data of the first accepted transfer to stdout, then exit"},
+		{"inbox={FILE}", "append received messages to {FILE}"},
+		{"max={SIZE}", "auto-reject offers larger than {SIZE} (e.g. 500MB, 2GB)"},
+		{"paired", "auto-reject offers and messages from senders that are not paired contacts"},
+		{"allow={CIDR,...}", "only answer discovery queries from these subnets"},
+		{"debug", "show discovery traffic and stats"},
+		{"hidden", "only answer discovery queries from paired contacts (or with token)"},
+		{"hidden token={TOKEN}", "only answer discovery queries from paired contacts or with {TOKEN}"},
+		{"hidden=full", "do not answer discovery queries (reachable via to= or address book)"},
 	},
 	sendCmd: {
 		{"file={FILE_PATH}", "finds peers and select one to send file to"},
 		{"file={FILE_PATH} for={NAME}", "find {NAME} peer and send file"},
+		{"file={FILE_PATH} for={ID}", "find peer with ID (or ID prefix) and send file"},
 		{"file={FILE_PATH} to={IPADDR:PORT}", "send file to specific address in local network"},
 		{"file={FILE_PATH} auto=1", "send file automatically if only 1 peer found"},
 		{"file={FILE_PATH} wait", "wait for timeout to finish finding peers"},
+		{"file={FILE_PATH} discovery={PORT}", "find peers using custom discovery port"},
+		{"file={FILE_PATH} token={TOKEN}", "find peers, including hidden peers with {TOKEN}"},
+		{"file={FOLDER}", "send folder and its contents"},
+		{"file={FOLDER} links=follow|keep|skip", "send files that symlinks point to, keep symlinks (default), or skip them"},
+		{"file={FOLDER} emptydirs", "include empty folders"},
+		{"stdin name={FILE_NAME} for={NAME}", "send data piped from stdin as {FILE_NAME}"},
+		{"stdin name={FILE_NAME} net={IP}", "send data from stdin using local network {IP} (required if there are multiple networks)"},
+		{"text={TEXT} for={NAME}", "send text message instead of file"},
 	},
 	findCmd: {
 		{"", "look for all peers in local network"},
 		{"name={NAME}", "look for peer {NAME} in local network"},
-		{"ip={IP_ADDR}", "look for peer with specified IP address in local network"},
+		{"id={ID}", "look for peer with specified ID (or ID prefix) in local network"},
+		{"ip={IP_ADDR}", "look for peer with specified IP address (probed directly)"},
+		{"scan={CIDR}", "probe all addresses in CIDR range (e.g. 10.0.5.0/24)"},
+		{"scan={CIDR} rate={N}", "probe CIDR range, at most {N} probes per second (default: 100)"},
 		{"wait", "wait for timeout to finish looking for peers"},
+		{"discovery={PORT}", "look for peers using custom discovery port"},
+		{"token={TOKEN}", "look for peers, including hidden peers with {TOKEN}"},
+	},
+	peersCmd: {
+		{"", "view address book and known contacts"},
+		{"add name={NAME} addr={IPADDR:PORT}", "add static peer to address book"},
+		{"remove name={NAME}", "remove static peer from address book"},
+		{"forget id={ID}", "forget known contact, so it can be paired again"},
+		{"trust id={ID}", "trust contact's key, replacing old keys of contacts with same name"},
+	},
+	relayCmd: {
+		{"", "relay discovery queries and announces between interfaces"},
+		{"proxy", "also proxy file transfers between interfaces"},
+		{"discovery={PORT}", "relay discovery queries on custom port"},
+		{"allow={CIDR,...}", "only relay discovery queries from these subnets"},
+		{"debug", "show relayed traffic and stats"},
 	},
 	updateCmd: {
 		{"", "update to latest version"},
@@ -120,14 +193,55 @@ var cmdOptions = map[string][][2]string{
 		{"", "view all logs"},
 		{"date={DATE}", "show logs for specified date"},
 		{"action={ACTION}", "show 'send' or 'receive' logs"},
-		{"from={NAME}", "show logs where sender is {NAME}"},
-		{"to={NAME}", "show logs where receiver is {NAME}"},
+		{"from={NAME|ID}", "show logs where sender is {NAME} or {ID}"},
+		{"to={NAME|ID}", "show logs where receiver is {NAME} or {ID}"},
 		{"file={FILENAME}", "show logs where file path contains filename substring"},
+		{"since={TIME}", "show logs since age (e.g. 7d, 12h), date, or RFC 3339 time"},
+		{"until={TIME}", "show logs until age (e.g. 1d), date, or RFC 3339 time"},
+		{"result={RESULT}", "show 'ok', 'fail', 'reject', or 'invalid' logs"},
+		{"peer={NAME|ID}", "show logs where sender or receiver is {NAME} or {ID}"},
+		{"min={SIZE}", "show logs where file size is at least {SIZE} (e.g. 1GB)"},
+		{"max={SIZE}", "show logs where file size is at most {SIZE}"},
+		{"sort={ORDER}", "sort logs by 'desc' (newest first, default), 'asc', or 'size'"},
+		{"limit={N}", "show at most {N} logs"},
+		{"format={csv|json|jsonl}", "export logs in machine-readable format (to stdout)"},
+		{"format={FORMAT} out={FILE}", "export logs to file (format defaults to file extension)"},
+		{"follow", "show last logs, then stream new logs and active transfers (tail -f style)"},
+		{"prune older={AGE}", "remove logs older than age (e.g. 90d), with confirmation"},
+		{"prune", "remove logs by the retention policy (set logage, logentries)"},
+		{"clear", "remove logs that pass the filters (all logs if no filter), with confirmation"},
+		{"clear dryrun", "list logs that would be removed, without removing"},
+		{"clear yes", "remove logs without confirmation"},
+	},
+	msgCmd: {
+		{"for={NAME} {MESSAGE}", "find {NAME} peer and send text message"},
+		{"for={ID} {MESSAGE}", "find peer with ID (or ID prefix) and send text message"},
+		{"to={IPADDR:PORT} {MESSAGE}", "send text message to specific address in local network"},
+		{"auto=1 {MESSAGE}", "send text message automatically if only 1 peer found"},
+		{"token={TOKEN} {MESSAGE}", "find peers, including hidden peers with {TOKEN}"},
+		{"wait=1 {MESSAGE}", "wait for timeout to finish looking for peers"},
+		{"net={IP} {MESSAGE}", "send text message using local network {IP}"},
+	},
+	resendCmd: {
+		{"id={ID}", "resend file (or message) of log #{ID} (ID or ID prefix shown in logs) to the same receiver"},
+		{"id={ID} yes", "resend file without confirmation, even if file has changed"},
+		{"id={ID} discovery={PORT}", "find receiver using custom discovery port, if its address has changed"},
+		{"id={ID} token={TOKEN}", "find hidden receiver with {TOKEN}, if its address has changed"},
+	},
+	statsCmd: {
+		{"", "view transfer statistics of all logs"},
+		{"since={TIME}", "compute statistics of logs since age (e.g. 30d), date, or RFC 3339 time"},
+		{"peer={NAME|ID}", "compute statistics of logs with peer {NAME} or {ID}"},
+		{"format=json", "output statistics as JSON"},
 	},
 }
 
-// Load user node
-func LoadNode(command string) (*Node, error) {
+// Load user node. Options: net=IP (local network to use, if multiple)
+func LoadNode(command string, options dict.StringMap) (*Node, error) {
+	// Prompts cannot read stdin if it is used for data
+	_, stdinData := options["stdin"]
+	canPrompt := !(command == sendCmd && stdinData)
+
 	// Get home directory
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -146,17 +260,24 @@ func LoadNode(command string) (*Node, error) {
 		hostName = compressName(hostName)
 		cfg = newConfig(hostName)
 		cfg.Path = path
+		if _, err = cfg.InitIdentity(); err != nil {
+			return nil, err
+		}
 		// Prompt user for custom name and timeout
 		fmt.Println("Welcome to dali!")
-		fmt.Print("Enter your name: ")
-		name := readInput()
-		if name != "" {
-			cfg.Name = name
-		}
-		fmt.Print("Set timeout (default: 3s): ")
-		wait := number.ParseInt(readInput())
-		if wait > 0 {
-			cfg.Timeout = wait
+		if canPrompt {
+			fmt.Print("Enter your name: ")
+			name := readInput()
+			if name != "" {
+				cfg.Name = name
+			}
+			fmt.Print("Set timeout (default: 3s): ")
+			wait := number.ParseInt(readInput())
+			if wait > 0 {
+				cfg.Timeout = wait
+			}
+		} else {
+			fmt.Printf("Using name %s and default timeout. Use `dali %s` to change them\n", cfg.Name, setCmd)
 		}
 		err = cfg.Save()
 		if err != nil {
@@ -171,10 +292,22 @@ func LoadNode(command string) (*Node, error) {
 			return nil, wrapErr("failed to load dali config", err)
 		}
 		cfg.Path = path
+		cfg.InitPorts()
+		cfg.InitLogPolicy()
+		// Generate identity for configs created before node IDs
+		created, err := cfg.InitIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			if err = cfg.Save(); err != nil {
+				return nil, wrapErr("failed to save node identity", err)
+			}
+		}
 	}
 
 	// Get local IP address
-	addr, err := getLocalIPv4Address(cmdSoloIP[command])
+	addr, err := getLocalIPv4Address(cmdSoloIP[command], options["net"], canPrompt)
 	if err != nil || addr == "" {
 		return nil, wrapErr("failed to get local IP addr", err)
 	}
@@ -182,6 +315,24 @@ func LoadNode(command string) (*Node, error) {
 	node := &Node{
 		Config: cfg,
 		Addr:   addr,
+		Events: &EventLog{
+			Path:   filepath.Join(homeDir, logsPath),
+			Policy: *cfg.LogPolicy,
+		},
+	}
+
+	// Move logs from config file (dali v0.1.4 and older) to event log
+	if len(cfg.Logs) > 0 {
+		if err = node.Events.Append(cfg.Logs...); err != nil {
+			return nil, wrapErr("failed to migrate logs", err)
+		}
+		err = cfg.Update(func(cfg *Config) error {
+			cfg.Logs = nil
+			return nil
+		})
+		if err != nil {
+			return nil, wrapErr("failed to save migrated config", err)
+		}
 	}
 	return node, nil
 }
@@ -272,19 +423,57 @@ func cmdUpdate(_ *Node, options dict.StringMap) error {
 
 // Set command handler
 func cmdSet(node *Node, options dict.StringMap) error {
-	// Options: name=NAME, timeout=X, wait=X
-	cfg := node.Config
-	for k, v := range options {
-		switch k {
-		case "name":
-			// Make sure name has no spaces
-			cfg.Name = compressName(v)
-		case "timeout", "wait":
-			// Clip new timeout value, with floor = minTimeout
-			cfg.Timeout = max(minTimeout, number.ParseInt(v))
+	// Options: name=NAME, timeout=X, wait=X, port=PORT, discovery=PORT, allow=CIDR,..., token=TOKEN,
+	// logsize=SIZE, logfiles=N, logentries=N, logage=AGE
+	err := node.Update(func(cfg *Config) error {
+		for k, v := range options {
+			switch k {
+			case "name":
+				// Make sure name has no spaces
+				cfg.Name = compressName(v)
+			case "timeout", "wait":
+				// Clip new timeout value, with floor = minTimeout
+				cfg.Timeout = max(minTimeout, number.ParseInt(v))
+			case "port", "discovery":
+				port, ok := parsePort(v)
+				if !ok {
+					return fmt.Errorf("invalid port %q", v)
+				}
+				if k == "port" {
+					cfg.Ports.Transfer = uint16(port)
+				} else {
+					cfg.Ports.Discovery = port
+				}
+			case "allow":
+				// Validate subnets, empty value clears the allowlist
+				subnets := splitList(v)
+				if _, err := newDiscoveryGuard("", subnets, false); err != nil {
+					return err
+				}
+				cfg.Allow = subnets
+			case "token":
+				cfg.Token = v
+			case "logsize":
+				size, ok := parseFileSize(v)
+				if !ok {
+					return fmt.Errorf("invalid log size %q", v)
+				}
+				cfg.LogPolicy.MaxSize = size
+			case "logfiles":
+				cfg.LogPolicy.MaxFiles = max(0, number.ParseInt(v))
+			case "logentries":
+				cfg.LogPolicy.MaxEntries = max(0, number.ParseInt(v))
+			case "logage":
+				age, ok := parseAge(v)
+				if !ok {
+					return fmt.Errorf("invalid log age %q", v)
+				}
+				cfg.LogPolicy.MaxAge = age
+			}
 		}
-	}
-	if err := cfg.Save(); err != nil {
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 	fmt.Println("Updated:")
@@ -294,23 +483,69 @@ func cmdSet(node *Node, options dict.StringMap) error {
 
 // Find command handler
 func cmdFind(node *Node, options dict.StringMap) error {
-	// Options: name=NAME, ip=IPAddr, wait
-	peerName, peerAddr := anything, anything
+	// Options: name=NAME, id=ID, ip=IPAddr, scan=CIDR, rate=PROBES_PER_SEC, discovery=PORT, token=TOKEN, wait
+	peerName, peerID, peerAddr := anything, anything, anything
+	token := node.Token
+	discoveryPort := node.Ports.Discovery
+	scanRange := ""
+	probeRate := defaultProbeRate
 	endASAP := true
 	for k, v := range options {
 		switch k {
 		case "name":
 			// Make sure name has no spaces
 			peerName = compressName(v)
+		case "id":
+			peerID = v
 		case "ip":
 			peerAddr = v
+		case "scan":
+			scanRange = v
+		case "rate":
+			probeRate = max(1, number.ParseInt(v))
+		case "token":
+			token = v
+		case "discovery":
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
+			}
+			discoveryPort = port
 		case "wait":
 			endASAP = false
 		}
 	}
 
+	params := Discovery{
+		Timeout:     time.Duration(node.Timeout) * time.Second,
+		Filter:      Peer{ID: peerID, Name: peerName, Addr: peerAddr},
+		EndASAP:     endASAP,
+		Port:        discoveryPort,
+		Query:       nodeQuery(node, token),
+		Contacts:    node.KnownContacts(),
+		StaticPeers: node.Peers,
+		ProbeRate:   probeRate,
+	}
+	if peerAddr != anything {
+		// Probe IP address directly, in case broadcast does not reach it
+		if ip := net.ParseIP(peerAddr); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", peerAddr)
+		}
+		params.Probes = []string{peerAddr}
+	}
+	if scanRange != "" {
+		probes, err := expandCIDR(scanRange)
+		if err != nil {
+			return err
+		}
+		params.Probes = append(params.Probes, probes...)
+		// Extend timeout to give time for sending all probes
+		params.Timeout += probeDuration(len(probes), probeRate)
+		fmt.Printf("Scanning %d addresses in %s (%d probes/s)...\n", len(probes), scanRange, probeRate)
+	}
+
 	fmt.Println(findingMessage(node))
-	peers, err := discoverPeers(node.Addr, time.Duration(node.Timeout)*time.Second, Peer{Name: peerName, Addr: peerAddr}, endASAP)
+	peers, err := discoverPeers(node.Addr, params)
 	if err != nil {
 		return err
 	}
@@ -321,48 +556,114 @@ func cmdFind(node *Node, options dict.StringMap) error {
 	}
 
 	fmt.Printf("Found %d peers:\n", len(peers))
-	maxLength := maxPeerNameLength(peers)
-	template := fmt.Sprintf("  • %%-%ds : %%s\n", maxLength)
-	for _, peer := range peers {
-		fmt.Printf(template, peer.Name, peer.Addr)
-	}
+	displayPeers(peers, false)
 	return nil
 }
 
 // Open command handler
 func cmdOpen(node *Node, options dict.StringMap) error {
-	// Options: port=CUSTOM_PORT, output=OUT_DIR, out=OUT_DIR, accept=auto, overwrite
-	listenPort := transferPort // default port
-	outputDir := "."           // default: current dir
-	autoAccept, overwrite := false, false
+	// Options: port=CUSTOM_PORT, discovery=CUSTOM_PORT, output=OUT_DIR, out=OUT_DIR, accept=auto, overwrite,
+	// noperms, stdout, inbox=FILE, max=SIZE, paired, allow=CIDR,..., debug, hidden, hidden=full, token=TOKEN
+	listenPort := node.Ports.Transfer      // default port
+	discoveryPort := node.Ports.Discovery  // default port
+	opts := receiveOptions{OutputDir: "."} // default: current dir
+	allow, token := node.Allow, node.Token
+	debug := false
+	hidden, fullyHidden := false, false
 	for k, v := range options {
 		switch k {
 		case "port":
-			customPort := number.ParseInt(v)
-			if customPort > 0 {
-				listenPort = uint16(customPort)
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
 			}
+			listenPort = uint16(port)
+		case "discovery":
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
+			}
+			discoveryPort = port
 		case "output", "out":
-			outputDir = v
+			opts.OutputDir = v
 		case "accept":
-			autoAccept = strings.ToLower(v) == "auto"
+			opts.AutoAccept = strings.ToLower(v) == "auto"
 		case "overwrite":
-			overwrite = true
+			opts.Overwrite = true
+		case "noperms":
+			opts.NoPerms = true
+		case "stdout":
+			opts.Stdout = dataOutput
+		case "inbox":
+			opts.Inbox = v
+		case "paired":
+			opts.PairedOnly = true
+		case "max":
+			maxSize, ok := parseFileSize(v)
+			if !ok {
+				return fmt.Errorf("invalid file size %q", v)
+			}
+			opts.MaxSize = uint64(maxSize)
+		case "allow":
+			allow = splitList(v)
+		case "debug":
+			debug = true
+		case "hidden":
+			hidden = true
+			fullyHidden = strings.ToLower(v) == "full"
+		case "token":
+			token = v
 		}
 	}
-	absOutputDir, err := filepath.Abs(outputDir)
+	guard, err := newDiscoveryGuard(node.Addr, allow, debug)
+	if err != nil {
+		return err
+	}
+	guard.hidden, guard.token = hidden, token
+	opts.Hidden, opts.Token = hidden, token
+
+	absOutputDir, err := filepath.Abs(opts.OutputDir)
 	if err != nil {
 		return wrapErr("failed to get absolute path of output dir", err)
 	}
+
+	// Bind transfer port first (with fallback ports), so we announce the actual port
+	listener, boundPort, err := listenTransfer(listenPort)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if boundPort != listenPort {
+		fmt.Printf("Port %d is unavailable, using port %d instead\n", listenPort, boundPort)
+	}
+
 	fmt.Printf("Output folder: %s\n", absOutputDir)
-	fmt.Printf("Listening for requests on local network at port %d...\n", listenPort)
+	if opts.MaxSize > 0 {
+		fmt.Printf("Max file size: %s\n", computeFileSize(opts.MaxSize))
+	}
+	if fullyHidden {
+		// No discovery listener: only reachable via to= or address book
+		fmt.Printf("Listening for requests at port %d (hidden, no discovery)...\n", boundPort)
+	} else {
+		discoveryConn, err := listenDiscovery(node, discoveryPort)
+		if err != nil {
+			return fmt.Errorf("%w (use discovery={PORT} to set another discovery port)", err)
+		}
+		defer discoveryConn.Close()
+
+		fmt.Printf("Listening for requests on local network at port %d (discovery: %d)...\n", boundPort, discoveryPort)
+		if hidden {
+			fmt.Println("Hidden: only answering queries from paired contacts", lang.Ternary(token != "", "or with token", ""))
+		}
+		if len(allow) > 0 {
+			fmt.Printf("Discovery allowed for: %s\n", strings.Join(allow, ", "))
+		}
 
-	// Run discovery listener in the background
-	go func() {
-		runDiscoveryListener(node, listenPort)
-	}()
+		// Run discovery listener in the background
+		go runDiscoveryListener(node, discoveryConn, boundPort, guard)
+	}
 
-	err = receiveFiles(node, listenPort, outputDir, autoAccept, overwrite)
+	err = receiveFiles(node, listener, opts)
 	if err != nil {
 		fmt.Println("Error:", err)
 	}
@@ -371,8 +672,13 @@ func cmdOpen(node *Node, options dict.StringMap) error {
 
 // Send command handler
 func cmdSend(node *Node, options dict.StringMap) error {
-	// Options: file=FILE_PATH, to=IPADDR:PORT, for=NAME, auto=1, wait
-	filePath, peerAddr, peerName := "", "", anything
+	// Options: file=FILE_PATH, to=IPADDR:PORT, for=NAME|ID, auto=1, discovery=PORT, token=TOKEN, wait,
+	// links=follow|keep|skip, emptydirs, stdin, name=FILE_NAME, text=TEXT
+	filePath, peerAddr, peerName, peerID, peerKey := "", "", anything, "", ""
+	token := node.Token
+	opts := defaultSendOptions()
+	text := ""
+	discoveryPort := node.Ports.Discovery
 	autoSend := false
 	endASAP := true
 	for k, v := range options {
@@ -385,23 +691,65 @@ func cmdSend(node *Node, options dict.StringMap) error {
 			peerName = v
 		case "auto":
 			autoSend = v == "1"
+		case "token":
+			token = v
+		case "discovery":
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
+			}
+			discoveryPort = port
 		case "wait":
 			endASAP = false
+		case "links":
+			opts.Links = strings.ToLower(v)
+		case "emptydirs":
+			opts.EmptyDirs = true
+		case "stdin":
+			opts.Stdin = true
+		case "name":
+			opts.Name = v
+		case "text":
+			text = v
 		}
 	}
 
-	if filePath == "" {
-		return fmt.Errorf("missing file path. Use file=<filePath>")
+	if !slices.Contains(linkPolicies, opts.Links) {
+		return fmt.Errorf("invalid links option %q. Use links=%s", opts.Links, strings.Join(linkPolicies, "|"))
 	}
 
-	if !io.PathExists(filePath) {
+	if text != "" {
+		filePath = "message"
+	} else if opts.Stdin {
+		if opts.Name == "" {
+			return fmt.Errorf("missing file name of stdin data. Use name=<fileName>")
+		}
+		if !isFileName(opts.Name) {
+			return fmt.Errorf("invalid file name %q. Use a name without folders", opts.Name)
+		}
+		filePath = "stdin"
+	} else if filePath == "" {
+		return fmt.Errorf("missing file path. Use file=<filePath>")
+	} else if !io.PathExists(filePath) {
 		return fmt.Errorf("file %q does not exist", filePath)
 	}
 
 	if peerAddr == "" {
 		// Find peers if no set peer address
+		filter := resolvePeerFilter(node, peerName)
+		if len(node.ContactIDs(peerName)) > 1 {
+			endASAP = false // wait for all peers sharing the name
+		}
 		fmt.Println(findingMessage(node))
-		peers, err := discoverPeers(node.Addr, time.Duration(node.Timeout)*time.Second, Peer{Name: peerName, Addr: anything}, endASAP)
+		peers, err := discoverPeers(node.Addr, Discovery{
+			Timeout:     time.Duration(node.Timeout) * time.Second,
+			Filter:      filter,
+			EndASAP:     endASAP,
+			Port:        discoveryPort,
+			Query:       nodeQuery(node, token),
+			Contacts:    node.KnownContacts(),
+			StaticPeers: node.Peers,
+		})
 		if err != nil {
 			return wrapErr("discovery failed", err)
 		}
@@ -419,14 +767,13 @@ func cmdSend(node *Node, options dict.StringMap) error {
 			if autoSend && numPeers == 1 {
 				// Check if autosend to any 1 peer
 				peerIdx = 0
+			} else if opts.Stdin {
+				// Cannot prompt: stdin is used for data
+				return fmt.Errorf("found %d peers. Use for=<name>, to=<addr> or auto=1 when sending from stdin", numPeers)
 			} else {
 				// Let user select recipient
 				fmt.Printf("\nFound %d peers:\n", numPeers)
-				maxLength := maxPeerNameLength(peers)
-				template := fmt.Sprintf("  [%%2d] %%-%ds : %%s\n", maxLength)
-				for i, peer := range peers {
-					fmt.Printf(template, i+1, peer.Name, peer.Addr)
-				}
+				displayPeers(peers, true)
 
 				fmt.Printf("\nEnter peer number to send to: ")
 				choice := number.ParseInt(readInput())
@@ -438,85 +785,434 @@ func cmdSend(node *Node, options dict.StringMap) error {
 		}
 
 		peer := peers[peerIdx]
-		peerName, peerAddr = peer.Name, peer.Addr
+		if peerName != anything && node.IsImpostor(peer) {
+			return fmt.Errorf("refusing to send: %s (%s) claims the identity of a known contact, but is %s", peer.Name, peer.Addr, peer.Status)
+		}
+		peerID, peerName, peerAddr, peerKey = peer.ID, peer.Name, peer.Addr, peer.PubKey
 	}
-	peer := Peer{Name: peerName, Addr: peerAddr}
+	peer := Peer{ID: peerID, Name: peerName, Addr: peerAddr, PubKey: peerKey}
 	fmt.Printf("Sending %q to %s (%s)...\n", filePath, peerName, peerAddr)
-	return sendFile(node, peer, filePath)
+	opts.Token = token
+	if text != "" {
+		return sendText(node, peer, text, token)
+	}
+	return sendFile(node, peer, filePath, opts)
 }
 
-// Logs command handler
-func cmdLogs(node *Node, options dict.StringMap) error {
-	// Options: date=DATE, action=ACTION, from=NAME, to=NAME, file=FILENAME_SUBSTRING
-	filterDate, filterAction, filterFile := anything, anything, anything
-	filterFrom, filterTo := anything, anything
+// Resend command handler
+func cmdResend(node *Node, options dict.StringMap) error {
+	// Options: id=LOG_ID, yes, discovery=PORT, token=TOKEN
+	id, confirmed := "", false
+	token := node.Token
+	discoveryPort := node.Ports.Discovery
 	for k, v := range options {
-		if v == "" {
-			continue
+		switch k {
+		case "id":
+			id = strings.TrimPrefix(strings.ToLower(v), "#")
+		case "yes":
+			confirmed = true
+		case "token":
+			token = v
+		case "discovery":
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
+			}
+			discoveryPort = port
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("missing log ID. Use id=<ID> (ID shown in `dali %s`)", logsCmd)
+	}
+
+	events, err := node.Events.ReadAll()
+	if err != nil {
+		return err
+	}
+	event, err := findSendEvent(events, id)
+	if err != nil {
+		return err
+	}
+	fmt.Print(eventLine(event, 0, 0))
+
+	changes := make([]string, 0)
+	if event.Kind != kindMessage {
+		changes, err = fileChanges(event)
+		if err != nil {
+			return err
 		}
+	}
+	if len(changes) > 0 {
+		fmt.Println(str.Red("Warning: file has changed since it was sent:"))
+		for _, change := range changes {
+			fmt.Printf("  • %s\n", change)
+		}
+		if !confirmed {
+			fmt.Print("Send anyway? [y/N]: ")
+			if answer := strings.ToLower(readInput()); answer != "y" && answer != "yes" {
+				fmt.Println("Cancelled")
+				return nil
+			}
+		}
+	}
+
+	peer, err := findReceiver(node, event.Receiver, findParams(node, discoveryPort, token))
+	if err != nil {
+		return err
+	}
+	if node.IsImpostor(peer) {
+		return fmt.Errorf("refusing to send: %s (%s) claims the identity of a known contact, but is %s", peer.Name, peer.Addr, peer.Status)
+	}
+	if event.Kind == kindMessage {
+		fmt.Printf("Sending message to %s (%s)...\n", peer.Name, peer.Addr)
+		return sendText(node, peer, event.Text, token)
+	}
+	fmt.Printf("Sending %q to %s (%s)...\n", event.Path, peer.Name, peer.Addr)
+	return sendFile(node, peer, event.Path, resendOptions(event, token))
+}
+
+// Msg command handler
+func cmdMsg(node *Node, options dict.StringMap) error {
+	// Options: for=NAME|ID, to=IPADDR:PORT, auto=1, discovery=PORT, token=TOKEN, wait=1, net=IP, text=TEXT
+	// Other arguments are words of the message (read from os.Args, as options are lowercased)
+	text, msgOptions := parseMsgArgs(os.Args[2:])
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("missing message. Use `dali %s for=<name> <message>`", msgCmd)
+	}
+	msgOptions["text"] = text
+	return cmdSend(node, msgOptions)
+}
+
+// Peers command handler
+func cmdPeers(node *Node, options dict.StringMap) error {
+	// Options: add, remove, forget, trust, name=NAME, addr=IPADDR:PORT, id=ID
+	action, name, addr, id := "", "", "", ""
+	for k, v := range options {
 		switch k {
-		case "date":
-			filterDate = v
-		case "action":
-			filterAction = strings.ToLower(v)
-		case "from":
-			filterFrom = strings.ToLower(v)
-		case "to":
-			filterTo = strings.ToLower(v)
-		case "file":
-			filterFile = strings.ToLower(v)
+		case "add", "remove", "forget", "trust":
+			action = k
+		case "name":
+			name = compressName(v)
+		case "addr":
+			addr = v
+		case "id":
+			id = v
 		}
 	}
-	logs := list.Filter(node.Logs, func(e Event) bool {
-		if filterDate != anything && clock.ExtractDate(e[evTimestamp]) != filterDate {
-			return false
+
+	switch action {
+	case "add":
+		if name == "" || addr == "" {
+			return fmt.Errorf("missing peer name or address. Use name=<name> addr=<ipAddr:port>")
 		}
-		if filterAction != anything && e[evType] != filterAction {
-			return false
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			// Use default transfer port if not specified
+			addr = net.JoinHostPort(addr, str.Int(int(node.Ports.Transfer)))
 		}
-		if filterFrom != anything && strings.ToLower(e[evSender]) != filterFrom {
-			return false
+		err := node.Update(func(cfg *Config) error {
+			cfg.AddPeer(name, addr)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		if filterTo != anything && strings.ToLower(e[evReceiver]) != filterTo {
-			return false
+		fmt.Printf("Added %s (%s) to address book\n", name, addr)
+		return nil
+	case "remove":
+		err := node.Update(func(cfg *Config) error {
+			if !cfg.RemovePeer(name) {
+				return fmt.Errorf("peer %q not found in address book", name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		if filterFile == anything {
-			return true
+		fmt.Printf("Removed %s from address book\n", name)
+		return nil
+	case "forget", "trust":
+		if id == "" {
+			return fmt.Errorf("missing contact ID. Use id=<ID>")
 		}
-		pattern := regexp.MustCompile("(?i)" + filterFile)
-		return pattern.MatchString(e[evPath])
+		contactID, err := node.FindContactID(id)
+		if err != nil {
+			return err
+		}
+		contact := node.KnownContacts()[contactID]
+		var removed []string
+		err = node.Update(func(cfg *Config) error {
+			if action == "forget" {
+				cfg.RemoveContact(contactID)
+				return nil
+			}
+			removed, err = cfg.TrustContact(contactID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if action == "forget" {
+			fmt.Printf("Forgot contact %s (%s)\n", contact.Name, contactID)
+		} else if len(removed) > 0 {
+			fmt.Printf("Trusted %s (%s), replacing %s\n", contact.Name, contactID, strings.Join(removed, ", "))
+		} else {
+			fmt.Printf("%s (%s) is already trusted\n", contact.Name, contactID)
+		}
+		return nil
+	}
+
+	fmt.Println("Address book:", len(node.Peers))
+	if len(node.Peers) > 0 {
+		displayPeers(node.Peers, false)
+	}
+
+	contacts := list.Map(dict.Keys(node.Contacts), func(id string) Peer {
+		contact := node.Contacts[id]
+		return Peer{ID: id, Name: contact.Name, Addr: contact.Addr}
 	})
+	slices.SortFunc(contacts, func(p1, p2 Peer) int {
+		return cmp.Compare(strings.ToLower(p1.Name), strings.ToLower(p2.Name))
+	})
+	fmt.Println("\nContacts:", len(contacts))
+	if len(contacts) > 0 {
+		displayPeers(contacts, false)
+	}
+	return nil
+}
+
+// Relay command handler
+func cmdRelay(node *Node, options dict.StringMap) error {
+	// Options: proxy, discovery=PORT, allow=CIDR,..., debug
+	discoveryPort := node.Ports.Discovery
+	allow := node.Allow
+	proxy, debug := false, false
+	for k, v := range options {
+		switch k {
+		case "proxy":
+			proxy = true
+		case "discovery":
+			port, ok := parsePort(v)
+			if !ok {
+				return fmt.Errorf("invalid port %q", v)
+			}
+			discoveryPort = port
+		case "allow":
+			allow = splitList(v)
+		case "debug":
+			debug = true
+		}
+	}
+
+	interfaces, err := getRelayInterfaces()
+	if err != nil {
+		return err
+	}
+	if len(interfaces) < 2 {
+		return fmt.Errorf("relay needs at least 2 network interfaces, found %d", len(interfaces))
+	}
+
+	guard, err := newDiscoveryGuard("", allow, debug)
+	if err != nil {
+		return err
+	}
+	guard.action = "relayed"
+
+	// Listen on all interfaces, to receive broadcasts from each subnet
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: discoveryPort})
+	if err != nil {
+		return wrapErr(fmt.Sprintf("failed to bind discovery port %d", discoveryPort), err)
+	}
+	defer conn.Close()
+
+	fmt.Println("Relaying discovery between:")
+	for _, iface := range interfaces {
+		fmt.Printf("  • %s %s (broadcast: %s)\n", iface.Subnet, str.Yellow(iface.Name), iface.Broadcast)
+	}
+	fmt.Printf("Listening for queries at port %d (proxy: %s)...\n", discoveryPort, lang.Ternary(proxy, "on", "off"))
+
+	r := &relay{
+		conn:       conn,
+		port:       discoveryPort,
+		interfaces: interfaces,
+		window:     time.Duration(node.Timeout) * time.Second,
+		guard:      guard,
+		proxy:      proxy,
+		proxies:    make(map[string]string),
+	}
+	return runRelay(r)
+}
+
+// Resolve for={NAME|ID} into discovery filter, using contact ID if target is known
+func resolvePeerFilter(node *Node, target string) Peer {
+	filter := Peer{ID: anything, Name: target, Addr: anything}
+	if target == anything {
+		return filter
+	}
+	// Use contact ID if name belongs to exactly one known contact
+	ids := node.ContactIDs(target)
+	if len(ids) == 0 {
+		// Check if target is a known contact ID (or ID prefix)
+		ids = list.Filter(dict.Keys(node.Contacts), func(id string) bool {
+			return matchesID(id, target)
+		})
+	}
+	if len(ids) == 1 {
+		return Peer{ID: ids[0], Name: anything, Addr: anything}
+	}
+	if len(ids) > 1 {
+		fmt.Printf("%q matches %d known contacts: %s\n", target, len(ids), strings.Join(ids, ", "))
+	}
+	return filter
+}
+
+// Logs command handler
+func cmdLogs(node *Node, options dict.StringMap) error {
+	// Options: date=DATE, since=TIME, until=TIME, action=ACTION, result=RESULT, from=NAME|ID, to=NAME|ID, peer=NAME|ID,
+	// file=FILENAME_SUBSTRING, min=SIZE, max=SIZE, sort=ORDER, limit=N, format=FORMAT, out=FILE, follow,
+	// prune, older=AGE, clear, dryrun, yes
+	filter, err := newLogFilter(options)
+	if err != nil {
+		return err
+	}
+	format, outPath := "", ""
+	order, limit := sortDesc, 0
+	follow, prune, clear, dryRun, confirmed := false, false, false, false, false
+	var olderThan time.Duration
+	for k, v := range options {
+		switch k {
+		case "follow":
+			follow = true
+		case "prune":
+			prune = true
+		case "clear":
+			clear = true
+		case "older":
+			age, ok := parseAge(v)
+			if !ok {
+				return fmt.Errorf("invalid age %q, use e.g. 90d, 2w, 12h", v)
+			}
+			olderThan, prune = age, true
+		case "dryrun", "dry":
+			dryRun = true
+		case "yes":
+			confirmed = true
+		case "sort":
+			order = strings.ToLower(v)
+		case "limit":
+			limit = number.ParseInt(v)
+			if limit <= 0 {
+				return fmt.Errorf("invalid limit %q", v)
+			}
+		case "format":
+			format = strings.ToLower(v)
+		case "out", "output":
+			outPath = v
+		}
+	}
+	if outPath != "" && format == "" {
+		// Use file extension as format
+		format = strings.ToLower(strings.TrimPrefix(filepath.Ext(outPath), "."))
+	}
+
+	events, err := node.Events.ReadAll()
+	if err != nil {
+		return err
+	}
+	if clear {
+		// Remove logs that pass the filter (all logs if no filter)
+		return deleteLogs(node.Events, events, filter.Match, dryRun, confirmed)
+	}
+	if prune {
+		// Remove logs older than age, or by the retention policy
+		expired := node.Events.Policy.Expired(events)
+		if olderThan > 0 {
+			cutoff := time.Now().Add(-olderThan)
+			expired = func(e Event) bool {
+				return e.Time.Before(cutoff)
+			}
+		} else if !node.Events.Policy.HasRetention() {
+			return fmt.Errorf("no retention policy set. Use older=<age>, or set logage=<age> / logentries=<N>")
+		}
+		return deleteLogs(node.Events, events, func(e Event) bool {
+			return expired(e) && filter.Match(e)
+		}, dryRun, confirmed)
+	}
+
+	logs := list.Filter(events, filter.Match)
+	if follow {
+		// Show last few logs (oldest first), then follow new logs
+		if limit == 0 {
+			limit = defaultFollowLimit
+		}
+		displayEvents(logs[max(0, len(logs)-limit):])
+		return followEvents(node.Events, filter)
+	}
+	if err = sortEvents(logs, order); err != nil {
+		return err
+	}
+	if limit > 0 && len(logs) > limit {
+		logs = logs[:limit]
+	}
+
+	if format != "" {
+		if !slices.Contains(logFormats, format) {
+			return fmt.Errorf("invalid format %q, use one of: %s", format, strings.Join(logFormats, ", "))
+		}
+		if outPath == "" {
+			return exportEvents(os.Stdout, logs, format)
+		}
+		file, err := os.Create(outPath)
+		if err != nil {
+			return wrapErr("failed to create export file", err)
+		}
+		defer file.Close()
+		if err = exportEvents(file, logs, format); err != nil {
+			return wrapErr("failed to export logs", err)
+		}
+		fmt.Printf("Exported %d logs to %q\n", len(logs), outPath)
+		return nil
+	}
+
 	numLogs := len(logs)
 	fmt.Println("Logs:", numLogs)
 	if numLogs == 0 {
 		fmt.Println("No logs found")
 		return nil
 	}
+	displayEvents(logs)
+	return nil
+}
 
-	slices.SortFunc(logs, func(e1, e2 Event) int {
-		// Sort by descending timestamp
-		return cmp.Compare(e2[evTimestamp], e1[evTimestamp])
-	})
-	fromMaxLength := slices.Max(list.Map(logs, func(e Event) int {
-		return len(e[evSender])
-	}))
-	toMaxLength := slices.Max(list.Map(logs, func(e Event) int {
-		return len(e[evReceiver])
-	}))
-	template := fmt.Sprintf("%%s %%s %%s from=%%-%ds to=%%-%ds %%7s %%s\n", fromMaxLength, toMaxLength)
-	for _, e := range logs {
-		timestamp, event, result, path, size, sender, receiver := e.Tuple()
-		event = str.Center(event, 8)
-		result = str.Center(result, 7)
-		size = computeFileSize(uint64(number.ParseInt(size)))
-		fmt.Printf(template, timestamp, event, result, sender, receiver, size, path)
+// Stats command handler
+func cmdStats(node *Node, options dict.StringMap) error {
+	// Options: same filters as logs command, format=json
+	filter, err := newLogFilter(options)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(options["format"])
+	if format != "" && format != formatJSON {
+		return fmt.Errorf("invalid format %q, use: %s", format, formatJSON)
+	}
+
+	events, err := node.Events.ReadAll()
+	if err != nil {
+		return err
+	}
+	stats := computeStats(list.Filter(events, filter.Match))
+	if format == formatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
 	}
+	displayStats(stats)
 	return nil
 }
 
 // Reset command handler
 func cmdReset(node *Node, _ dict.StringMap) error {
-	err := os.Remove(node.Config.Path)
+	err := errors.Join(os.Remove(node.Config.Path), node.Events.Remove())
+	os.Remove(node.Config.Path + ".lock")
 	fmt.Println("dali reset", lang.Ternary(err == nil, "successful", "failed"))
 	return err
 }
@@ -1,23 +1,50 @@
 package dali
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/roidaradal/fn/dict"
+	"github.com/roidaradal/fn/lang"
 	"github.com/roidaradal/fn/list"
+	"github.com/roidaradal/fn/str"
 )
 
-const readDeadlineMs int = 100
+const (
+	readDeadlineMs   int = 100
+	pingTimeout          = 2 * time.Second
+	defaultProbeRate int = 100 // Default unicast probes per second
+)
 
 type Peer struct {
-	Name string
-	Addr string
+	ID     string
+	Name   string
+	Addr   string
+	PubKey string `json:",omitempty"` // public key, if verified
+	Status string `json:"-"`          // verification status
+}
+
+// Discovery parameters
+type Discovery struct {
+	Timeout     time.Duration
+	Filter      Peer
+	EndASAP     bool
+	Port        int                // discovery port
+	Query       *DiscoveryMessage  // signed query, with optional token proof
+	Contacts    map[string]Contact // known contacts, for verification status
+	StaticPeers []Peer             // address book peers, probed via unicast query and TCP ping
+	Probes      []string           // IP addresses probed via unicast query
+	ProbeRate   int                // max unicast probes per second
 }
 
-// DiscoverPeers broadcasts a query and collects peer responses
-func discoverPeers(nodeAddr string, timeout time.Duration, filter Peer, endASAP bool) ([]Peer, error) {
+// DiscoverPeers broadcasts a query, probes static peers and IP addresses, and collects peer responses
+func discoverPeers(nodeAddr string, params Discovery) ([]Peer, error) {
+	timeout, filter, endASAP, staticPeers := params.Timeout, params.Filter, params.EndASAP, params.StaticPeers
 	// Create UDP socket for sending, port 0 = auto-select open port
 	// Used to be 0.0.0.0 address, but changed to chosen nodeAddr (for multiple IPs)
 	addr := &net.UDPAddr{
@@ -33,29 +60,87 @@ func discoverPeers(nodeAddr string, timeout time.Duration, filter Peer, endASAP
 	// Send query to broadcast address, 255.255.255.255:<DISCOVERY_PORT>
 	broadcastAddr := &net.UDPAddr{
 		IP:   net.IPv4bcast,
-		Port: discoveryPort,
+		Port: params.Port,
+	}
+	queryMsg := params.Query
+	if queryMsg == nil {
+		queryMsg = newQueryMessage("")
 	}
-	query := newQueryMessage()
-	_, err = conn.WriteToUDP(query.ToBytes(), broadcastAddr)
+	query, err := queryMsg.ToPacket(packetVersion)
 	if err != nil {
-		return nil, wrapErr("failed to send discovery query", err)
+		return nil, wrapErr("failed to create discovery query", err)
+	}
+	// Also send legacy query, as dali v0.1.4 and older only answer plain JSON queries
+	legacyQuery, err := queryMsg.ToPacket(legacyVersion)
+	if err != nil {
+		return nil, wrapErr("failed to create discovery query", err)
+	}
+	queries := [][]byte{query, legacyQuery}
+	for _, data := range queries {
+		_, err = conn.WriteToUDP(data, broadcastAddr)
+		if err != nil {
+			return nil, wrapErr("failed to send discovery query", err)
+		}
+	}
+
+	// Send unicast query to static peers, for peers that broadcast cannot reach
+	alias := make(dict.StringMap)
+	for _, peer := range staticPeers {
+		alias[peer.Addr] = peer.Name
+		host, _, err := net.SplitHostPort(peer.Addr)
+		if err != nil {
+			continue
+		}
+		peerAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, str.Int(params.Port)))
+		if err != nil {
+			continue
+		}
+		for _, data := range queries {
+			conn.WriteToUDP(data, peerAddr)
+		}
 	}
 
+	// Send unicast query to probe addresses in the background, with rate limit
+	stop := make(chan struct{})
+	defer close(stop)
+	go sendProbes(conn, queries, params.Probes, params.Port, params.ProbeRate, stop)
+
 	// Collect responses
 	var peers []Peer
-
-	targetName := strings.ToLower(filter.Name)
-	targetAddr := fmt.Sprintf("%s:", filter.Addr)
+	hasFilter := filter.ID != anything || filter.Name != anything || filter.Addr != anything
+	// Add peer of announce, returns true if discovery can end early
+	addPeer := func(msg *DiscoveryMessage) bool {
+		peer := verifiedPeer(msg, params.Contacts)
+		if !filter.Matches(peer, alias[peer.Addr]) {
+			return false
+		}
+		// Add peer, unless it already exists (same ID, or same address for peers without ID)
+		var added bool
+		if peers, added = mergePeer(peers, peer); !added {
+			return false
+		}
+		// End ASAP if we found verified peer that satisfies filter (others may be impostors)
+		return hasFilter && endASAP && (peer.Status == statusTrusted || peer.Status == statusVerified)
+	}
+	// Full announces of truncated announces are fetched over TCP in the background
+	fetcher := newAnnounceFetcher(queryMsg, stop)
 
 	// Goroutine for collecting responses
 	readDuration := time.Duration(readDeadlineMs) * time.Millisecond
-	buf := make([]byte, 1024)
+	buf := make([]byte, readBufSize)
 	done := time.After(timeout)
+	endedEarly := false
 mainLoop:
 	for {
 		select {
 		case <-done:
 			break mainLoop // exit loop after timeout finishes
+		case msg := <-fetcher.results:
+			fetcher.active--
+			if msg != nil && addPeer(msg) {
+				endedEarly = true
+				break mainLoop
+			}
 		default:
 			conn.SetReadDeadline(time.Now().Add(readDuration))
 			n, _, err := conn.ReadFromUDP(buf)
@@ -63,72 +148,371 @@ mainLoop:
 				continue
 			}
 
-			msg, err := parseMessage[DiscoveryMessage](buf[:n])
+			msg, err := parsePacket(buf[:n])
 			if err != nil || msg.Type != announceType {
 				continue // skip on error or non-Announcement messages
 			}
 
-			peerAddr := fmt.Sprintf("%s:%d", msg.Addr, msg.TransferPort)
-
-			// Check if peer already exists
-			exists := list.Any(peers, func(p Peer) bool {
-				return p.Addr == peerAddr
-			})
-			if exists {
+			if msg.Truncated {
+				if !hasPeer(peers, msg.Peer()) {
+					fetcher.Fetch(msg)
+				}
 				continue
 			}
-
-			if filter.Name != anything && strings.ToLower(msg.Name) != targetName {
-				continue // skip if name not matched
+			if addPeer(msg) {
+				endedEarly = true
+				break mainLoop
 			}
+		}
+	}
+	// Wait for full announces that are still being fetched
+	for !endedEarly && fetcher.active > 0 {
+		fetcher.active--
+		if msg := <-fetcher.results; msg != nil && addPeer(msg) {
+			endedEarly = true
+		}
+	}
+
+	if hasFilter && endASAP && len(peers) > 0 {
+		return peers, nil
+	}
 
-			if filter.Addr != anything && !strings.HasPrefix(peerAddr, targetAddr) {
-				continue // skip if addr not matched
+	// Ping static peers that did not answer the query (e.g. UDP is blocked), concurrently
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, staticPeer := range staticPeers {
+		if !filter.Matches(Peer{Name: staticPeer.Name, Addr: staticPeer.Addr}, staticPeer.Name) {
+			continue
+		}
+		found := list.Any(peers, func(p Peer) bool {
+			return p.Addr == staticPeer.Addr
+		})
+		if found {
+			continue
+		}
+		wg.Go(func() {
+			pong, err := pingPeer(staticPeer.Addr, queryMsg, timeout)
+			if err != nil {
+				return
+			}
+			// Use static address, as announced address may not be reachable
+			peer := pongPeer(pong, queryMsg, params.Contacts)
+			peer.Addr = staticPeer.Addr
+			mu.Lock()
+			defer mu.Unlock()
+			if filter.Matches(peer, staticPeer.Name) {
+				peers, _ = mergePeer(peers, peer)
 			}
+		})
+	}
+	wg.Wait()
+
+	return peers, nil
+}
+
+// Max number of full announces fetched at the same time
+const maxAnnounceFetches int = 8
+
+// Fetches full announces of truncated announces over TCP, concurrently (bounded), and at most once per address
+type announceFetcher struct {
+	query   *DiscoveryMessage
+	slots   chan struct{}
+	results chan *DiscoveryMessage // full announce, or nil if fetch failed
+	pending map[string]bool        // addresses already fetched or being fetched
+	active  int                    // number of fetches whose result was not received yet
+	stop    <-chan struct{}
+}
+
+// Create new announceFetcher, fetches are abandoned when stop is closed
+func newAnnounceFetcher(query *DiscoveryMessage, stop <-chan struct{}) *announceFetcher {
+	return &announceFetcher{
+		query:   query,
+		slots:   make(chan struct{}, maxAnnounceFetches),
+		results: make(chan *DiscoveryMessage),
+		pending: make(map[string]bool),
+		stop:    stop,
+	}
+}
 
-			peers = append(peers, Peer{
-				Name: msg.Name,
-				Addr: peerAddr,
-			})
+// Fetch full announce of truncated announce in the background, unless its address is already pending.
+// Result is sent to results channel
+func (f *announceFetcher) Fetch(msg *DiscoveryMessage) {
+	addr := msg.Peer().Addr
+	if f.pending[addr] {
+		return
+	}
+	f.pending[addr] = true
+	f.active++
+	go func() {
+		var full *DiscoveryMessage
+		select {
+		case f.slots <- struct{}{}:
+			if pong, err := pingPeer(addr, f.query, pingTimeout); err == nil {
+				// Keep relay proxy address
+				full = pong.Announce
+				full.Via = msg.Via
+			}
+			<-f.slots
+		case <-f.stop:
+			return
+		}
+		select {
+		case f.results <- full:
+		case <-f.stop:
+		}
+	}()
+}
 
-			if (filter.Name != anything || filter.Addr != anything) && endASAP {
-				break mainLoop // end ASAP if we found peer that satisfies filter
+// Send unicast queries to each probe IP address, at most rate probes per second
+func sendProbes(conn *net.UDPConn, queries [][]byte, probes []string, port, rate int, stop <-chan struct{}) {
+	if len(probes) == 0 {
+		return
+	}
+	if rate <= 0 {
+		rate = defaultProbeRate
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for _, ip := range probes {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			probeAddr := &net.UDPAddr{
+				IP:   newIPv4(ip),
+				Port: port,
+			}
+			for _, data := range queries {
+				conn.WriteToUDP(data, probeAddr)
 			}
 		}
 	}
+}
 
-	return peers, nil
+// Compute time needed to send probes at the given rate
+func probeDuration(numProbes, rate int) time.Duration {
+	if rate <= 0 {
+		rate = defaultProbeRate
+	}
+	return time.Duration(numProbes) * time.Second / time.Duration(rate)
 }
 
-// RunDiscoveryListener listens for discovery queries and responds with announcements
-func runDiscoveryListener(node *Node, transferPort uint16) error {
+// Check if peer matches the filter (ID, name or alias, address)
+func (filter Peer) Matches(peer Peer, alias string) bool {
+	if filter.ID != anything && !matchesID(peer.ID, filter.ID) {
+		return false // ID not matched
+	}
+	if filter.Name != anything {
+		target := strings.ToLower(filter.Name)
+		nameMatched := strings.ToLower(peer.Name) == target || strings.ToLower(alias) == target
+		if !nameMatched && !matchesID(peer.ID, filter.Name) {
+			return false // name, alias, or ID prefix not matched
+		}
+	}
+	if filter.Addr != anything && !strings.HasPrefix(peer.Addr, filter.Addr+":") {
+		return false // addr not matched
+	}
+	return true
+}
+
+// Check if peer is already in list of peers
+func hasPeer(peers []Peer, peer Peer) bool {
+	return list.Any(peers, peer.SameKey)
+}
+
+// Add peer to peers, or replace peer with the same key if only the new one is signed and direct
+// (prefer signed direct announce over unsigned impostor or relay proxy). Returns true if added or replaced
+func mergePeer(peers []Peer, peer Peer) ([]Peer, bool) {
+	idx := slices.IndexFunc(peers, peer.SameKey)
+	switch {
+	case idx < 0:
+		return append(peers, peer), true
+	case !peers[idx].IsSignedDirect() && peer.IsSignedDirect():
+		peers[idx] = peer
+		return peers, true
+	}
+	return peers, false
+}
+
+// Check if peer's announce is signed and was received directly (not through a relay)
+func (p Peer) IsSignedDirect() bool {
+	return p.Status != statusUnknown && p.Status != statusRelayed
+}
+
+// Check if peers have the same deduplication key
+func (p Peer) SameKey(other Peer) bool {
+	return p.Key() == other.Key()
+}
+
+// Create node's announce message
+func nodeAnnounce(node *Node, transferPort uint16) *DiscoveryMessage {
+	self := node.Identity()
+	announce := newAnnounceMessage(self.ID, compressName(self.Name), node.Addr, transferPort)
+	if key, err := self.SigningKey(); err == nil {
+		announce.Sign(key)
+	}
+	return announce
+}
+
+// Create node's signed query message, with token proof if token is set
+func nodeQuery(node *Node, token string) *DiscoveryMessage {
+	self := node.Identity()
+	query := newQueryMessage(self.ID)
+	if token != "" {
+		query.Proof = tokenProof(token, query.Nonce, query.Time)
+	}
+	if key, err := self.SigningKey(); err == nil {
+		query.Sign(key)
+	}
+	return query
+}
+
+// Create Peer from announce message, with verification status
+func verifiedPeer(msg *DiscoveryMessage, contacts map[string]Contact) Peer {
+	peer := msg.Peer()
+	peer.Status = peerStatus(contacts, msg)
+	if peer.IsSignedDirect() {
+		peer.PubKey = msg.PubKey
+	}
+	return peer
+}
+
+// Create Peer from ping response. Peer is only verified if the signed pong answers our query,
+// as any host can replay a contact's signed announce
+func pongPeer(pong *TransferMessage, query *DiscoveryMessage, contacts map[string]Contact) Peer {
+	if pong.AnswersQuery(query) {
+		return verifiedPeer(pong.Announce, contacts)
+	}
+	peer := pong.Announce.Peer()
+	peer.Status = statusUnknown
+	return peer
+}
+
+// Create Peer from announce message, using relay proxy address if available
+func (m *DiscoveryMessage) Peer() Peer {
+	addr := fmt.Sprintf("%s:%d", m.Addr, m.TransferPort)
+	if m.Via != "" {
+		addr = m.Via
+	}
+	return Peer{
+		ID:   m.ID,
+		Name: m.Name,
+		Addr: addr,
+	}
+}
+
+// Peer key used for deduplication: ID if available, otherwise address
+func (p Peer) Key() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.Addr
+}
+
+// Get names shared by peers with different IDs
+func nameCollisions(peers []Peer) map[string]bool {
+	ids := make(map[string]map[string]bool)
+	for _, peer := range peers {
+		name := strings.ToLower(peer.Name)
+		if ids[name] == nil {
+			ids[name] = make(map[string]bool)
+		}
+		ids[name][peer.Key()] = true
+	}
+	collision := make(map[string]bool)
+	for name, keys := range ids {
+		if len(keys) > 1 {
+			collision[name] = true
+		}
+	}
+	return collision
+}
+
+// Display list of peers, numbered if for selection
+func displayPeers(peers []Peer, numbered bool) {
+	collision := nameCollisions(peers)
+	maxLength := maxPeerNameLength(peers)
+	prefix := "  •"
+	for i, peer := range peers {
+		if numbered {
+			prefix = fmt.Sprintf("  [%2d]", i+1)
+		}
+		id := lang.Ternary(peer.ID == "", "(no ID)", peer.ID)
+		note := ""
+		if color, ok := statusColor[peer.Status]; ok {
+			note += " " + color(str.Center(peer.Status, 10))
+		}
+		if collision[strings.ToLower(peer.Name)] {
+			note += str.Red(" (name collision)")
+		}
+		template := fmt.Sprintf("%%s %%-%ds : %%-21s %%-16s%%s\n", maxLength)
+		fmt.Printf(template, prefix, peer.Name, peer.Addr, id, note)
+	}
+}
+
+// Bind UDP socket for listening to discovery queries
+func listenDiscovery(node *Node, port int) (*net.UDPConn, error) {
 	// Create UDP socket for listening, address at 0.0.0.0:<DISCOVERY_PORT>
 	// Used to be 0.0.0.0, but replaced with selected nodeAddr
 	addr := &net.UDPAddr{
 		IP:   newIPv4(node.Addr), // old value: net.IPv4zero
-		Port: discoveryPort,
+		Port: port,
 	}
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
-		return wrapErr("failed to bind discovery port", err)
+		return nil, wrapErr(fmt.Sprintf("failed to bind discovery port %d", port), err)
 	}
-	defer conn.Close()
+	return conn, nil
+}
 
-	buf := make([]byte, 1024)
+// RunDiscoveryListener listens for discovery queries and responds with announcements
+func runDiscoveryListener(node *Node, conn *net.UDPConn, transferPort uint16, guard *discoveryGuard) {
+	go guard.ReportStats()
+	buf := make([]byte, readBufSize)
 	for {
 		n, peerAddr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
 
-		msg, err := parseMessage[DiscoveryMessage](buf[:n])
-		if err != nil || msg.Type != queryType {
-			continue // skip on error or non-Query messages
+		// Check own address, allowlist, and rate limit before parsing
+		if ok, reason := guard.Check(peerAddr.IP); !ok {
+			guard.Drop(peerAddr, reason)
+			continue
 		}
 
-		// Respond with our announcement
-		name := compressName(node.Name)
-		announce := newAnnounceMessage(name, node.Addr, transferPort)
-		conn.WriteToUDP(announce.ToBytes(), peerAddr)
+		msg, err := parsePacket(buf[:n])
+		if err != nil {
+			guard.Drop(peerAddr, dropInvalid)
+			continue
+		}
+		if msg.Type != queryType {
+			guard.Drop(peerAddr, dropNotQuery)
+			continue // skip non-Query messages
+		}
+		if msg.IsLegacyCopy() {
+			guard.Drop(peerAddr, dropLegacyCopy)
+			continue // already answered the versioned query
+		}
+		if ok, reason := guard.CheckQuery(msg, node.KnownContacts()); !ok {
+			guard.Drop(peerAddr, reason)
+			continue
+		}
+
+		// Respond with our announcement, in the query's packet version
+		announce := nodeAnnounce(node, transferPort)
+		data, err := announce.ToPacket(msg.Version)
+		if errors.Is(err, errPacketTooLarge) {
+			// Send compact announce, full announce can be fetched over TCP
+			data, err = announce.Compact().ToPacket(msg.Version)
+		}
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDP(data, peerAddr)
+		guard.Answer(peerAddr)
 	}
 }
@@ -0,0 +1,121 @@
+package dali
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPongPeerReplay(t *testing.T) {
+	alice := newTestNode(t)
+	key, err := alice.SigningKey()
+	if err != nil {
+		t.Fatalf("failed to get signing key: %v", err)
+	}
+	contacts := map[string]Contact{alice.ID: {Name: alice.Name, Key: encodePublicKey(key)}}
+
+	// Pong signed by alice for an earlier query
+	oldQuery := newQueryMessage("bob")
+	pong := newPongMessage(nodeAnnounce(alice, 45679))
+	pong.Query = oldQuery
+	pong.Sign(key)
+
+	if peer := pongPeer(pong, oldQuery, contacts); peer.Status != statusTrusted || peer.PubKey == "" {
+		t.Fatalf("expected trusted peer for answered query, got %s", peer.Status)
+	}
+	// Replayed by another host for a new query
+	if peer := pongPeer(pong, newQueryMessage("bob"), contacts); peer.Status != statusUnknown || peer.PubKey != "" {
+		t.Fatalf("expected unknown peer for replayed pong, got %s", peer.Status)
+	}
+	// Unsigned pong
+	unsigned := newPongMessage(nodeAnnounce(alice, 45679))
+	unsigned.Query = oldQuery
+	if peer := pongPeer(unsigned, oldQuery, contacts); peer.Status != statusUnknown {
+		t.Fatalf("expected unknown peer for unsigned pong, got %s", peer.Status)
+	}
+}
+
+func TestMergePeer(t *testing.T) {
+	impostor := Peer{ID: "abc", Name: "alice", Addr: "10.0.0.66:45679", Status: statusUnknown}
+	relayed := Peer{ID: "abc", Name: "alice", Addr: "10.0.1.1:40000", Status: statusRelayed}
+	alice := Peer{ID: "abc", Name: "alice", Addr: "10.0.0.5:45679", Status: statusTrusted}
+	tests := []struct {
+		name  string
+		first Peer
+		next  Peer
+		want  Peer
+		added bool
+	}{
+		{"verified replaces unknown", impostor, alice, alice, true},
+		{"verified replaces relayed", relayed, alice, alice, true},
+		{"unknown does not replace verified", alice, impostor, alice, false},
+		{"relayed does not replace verified", alice, relayed, alice, false},
+		{"unknown does not replace unknown", impostor, Peer{ID: "abc", Status: statusUnknown}, impostor, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers, _ := mergePeer(nil, test.first)
+			peers, added := mergePeer(peers, test.next)
+			if len(peers) != 1 || peers[0] != test.want || added != test.added {
+				t.Fatalf("expected %+v (added=%v), got %+v (added=%v)", test.want, test.added, peers, added)
+			}
+		})
+	}
+	if peers, added := mergePeer([]Peer{alice}, Peer{ID: "def", Status: statusUnknown}); len(peers) != 2 || !added {
+		t.Fatalf("expected peer with other ID to be added, got %+v", peers)
+	}
+}
+
+func TestAnnounceFetcher(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	fetcher := newAnnounceFetcher(newQueryMessage(""), stop)
+
+	// Peers answer pings slowly, counting concurrent fetches
+	var active, maxActive, pings atomic.Int32
+	numPeers := 2 * maxAnnounceFetches
+	for i := range numPeers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer listener.Close()
+		port := uint16(listener.Addr().(*net.TCPAddr).Port)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				pings.Add(1)
+				maxActive.Store(max(maxActive.Load(), active.Add(1)))
+				bufio.NewReader(conn).ReadString('\n')
+				time.Sleep(50 * time.Millisecond)
+				announce := newAnnounceMessage(string(rune('a'+i)), "peer", "127.0.0.1", port)
+				active.Add(-1)
+				conn.Write(newPongMessage(announce).ToBytes())
+				conn.Close()
+			}
+		}()
+		compact := &DiscoveryMessage{Type: announceType, Addr: "127.0.0.1", TransferPort: port, Truncated: true}
+		for range 3 {
+			fetcher.Fetch(compact) // repeated announces of the same address are fetched once
+		}
+	}
+	if fetcher.active != numPeers {
+		t.Fatalf("expected %d pending fetches, got %d", numPeers, fetcher.active)
+	}
+	for range numPeers {
+		if msg := <-fetcher.results; msg == nil || msg.Name != "peer" {
+			t.Fatalf("expected full announce, got %+v", msg)
+		}
+	}
+	if n := pings.Load(); n != int32(numPeers) {
+		t.Fatalf("expected %d pings, got %d", numPeers, n)
+	}
+	if n := maxActive.Load(); n > int32(maxAnnounceFetches) {
+		t.Fatalf("expected at most %d concurrent fetches, got %d", maxAnnounceFetches, n)
+	}
+}
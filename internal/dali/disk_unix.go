@@ -0,0 +1,14 @@
+//go:build !windows
+
+package dali
+
+import "golang.org/x/sys/unix"
+
+// Get free space (bytes available to user) of the volume containing the folder
+func freeSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
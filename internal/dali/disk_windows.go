@@ -0,0 +1,18 @@
+//go:build windows
+
+package dali
+
+import "golang.org/x/sys/windows"
+
+// Get free space (bytes available to user) of the volume containing the folder
+func freeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err = windows.GetDiskFreeSpaceEx(path, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,147 @@
+package dali
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/number"
+)
+
+// Event schema version, stored in each event. Readers ignore unknown fields,
+// so new fields can be added without breaking older versions
+const eventSchema int = 1
+
+// Event action
+type EventAction string
+
+const (
+	actionSend    EventAction = "send"
+	actionReceive EventAction = "receive"
+)
+
+// Event kind: empty for file transfer
+type EventKind string
+
+const kindMessage EventKind = "message"
+
+// Event result
+type EventResult string
+
+const (
+	resultOK      EventResult = "ok"
+	resultFail    EventResult = "fail"
+	resultReject  EventResult = "reject"
+	resultInvalid EventResult = "invalid"
+)
+
+// Sender or receiver of transfer event
+type EventPeer struct {
+	Name string
+	ID   string `json:",omitempty"`
+	Addr string `json:",omitempty"`
+}
+
+// Number of random bytes of event ID
+const eventIDLength int = 4
+
+// Activity log event (file transfer or message)
+type Event struct {
+	Schema     int
+	ID         string `json:",omitempty"` // stable event ID, used by resend (derived from event if not stored)
+	Time       time.Time
+	Action     EventAction
+	Result     EventResult
+	Path       string
+	Size       uint64
+	Duration   time.Duration `json:",omitempty"` // data transfer duration
+	Throughput float64       `json:",omitempty"` // bytes per second
+	Sender     EventPeer
+	Receiver   EventPeer
+	Checksum   string    `json:",omitempty"` // SHA-256 of file data
+	ModTime    time.Time `json:",omitzero"`  // modification time of file (when sent)
+	Stream     bool      `json:",omitempty"` // piped data, size unknown until transfer is done
+	Kind       EventKind `json:",omitempty"` // message, or empty for file transfer
+	Text       string    `json:",omitempty"` // text of message
+	Reason     string    `json:",omitempty"` // accept or reject reason code
+	Note       string    `json:",omitempty"` // receiver's note on accept or reject
+	SavedAs    string    `json:",omitempty"` // final file name chosen by receiver
+	Links      string    `json:",omitempty"` // symlink policy of sent folder, reused by resend
+	EmptyDirs  bool      `json:",omitempty"` // empty folders were included in sent folder, reused by resend
+	Error      string    `json:",omitempty"`
+}
+
+// Create new event with empty result
+func newEvent(action EventAction, path string, size uint64, sender, receiver EventPeer) Event {
+	id := make([]byte, eventIDLength)
+	rand.Read(id)
+	return Event{
+		Schema:   eventSchema,
+		ID:       hex.EncodeToString(id),
+		Time:     clock.Now(),
+		Action:   action,
+		Path:     path,
+		Size:     size,
+		Sender:   sender,
+		Receiver: receiver,
+	}
+}
+
+// Set transfer duration, throughput, and checksum of event
+func (e *Event) SetStats(start time.Time, numBytes uint64, checksum hash.Hash) {
+	e.Duration = time.Since(start)
+	if seconds := e.Duration.Seconds(); seconds > 0 {
+		e.Throughput = float64(numBytes) / seconds
+	}
+	e.Checksum = hex.EncodeToString(checksum.Sum(nil))
+}
+
+// Decode event from JSON object, or legacy event array (dali v0.1.4 and older):
+// [Timestamp, Type, Result, FilePath, FileSize, SenderName, ReceiverName, SenderID, ReceiverID]
+func (e *Event) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		type event Event // no methods, prevents recursion
+		if err := json.Unmarshal(data, (*event)(e)); err != nil {
+			return err
+		}
+		if e.ID == "" {
+			e.ID = e.derivedID() // logged before event IDs
+		}
+		return nil
+	}
+	var legacy []string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	legacy = append(legacy, make([]string, max(0, 9-len(legacy)))...)
+	timestamp, err := clock.ParseDateTime(legacy[0])
+	if err != nil {
+		return wrapErr("invalid legacy event timestamp", err)
+	}
+	*e = Event{
+		Schema:   0, // migrated from legacy event
+		Time:     timestamp,
+		Action:   EventAction(legacy[1]),
+		Result:   EventResult(legacy[2]),
+		Path:     legacy[3],
+		Size:     uint64(max(0, number.ParseInt(legacy[4]))),
+		Sender:   EventPeer{Name: legacy[5], ID: legacy[7]},
+		Receiver: EventPeer{Name: legacy[6], ID: legacy[8]},
+	}
+	e.ID = e.derivedID()
+	return nil
+}
+
+// Compute stable ID of event without stored ID, from its time, action, path and peers
+func (e Event) derivedID() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s|%s|%s|%s|%s", e.Time.Format(time.RFC3339Nano), e.Action, e.Path, e.Sender.Name, e.Receiver.Name)
+	return hex.EncodeToString(hash.Sum(nil)[:eventIDLength])
+}
@@ -0,0 +1,346 @@
+package dali
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/list"
+)
+
+const (
+	logsPath           string = ".dali.logs" // Full path: ~HOME/.dali.logs
+	defaultLogMaxSize  int64  = 1 << 20      // Rotate log file at 1MB
+	defaultLogMaxFiles int    = 5            // Number of rotated log files to keep
+)
+
+// Log rotation and retention settings
+type LogPolicy struct {
+	MaxSize    int64         // rotate current log file when it reaches this size (bytes)
+	MaxFiles   int           // number of rotated log files to keep (older ones are deleted)
+	MaxEntries int           `json:",omitempty"` // number of newest events to keep, 0 = all
+	MaxAge     time.Duration `json:",omitempty"` // delete events older than this, 0 = never
+}
+
+// Check if retention policy (max entries or max age) is set
+func (p LogPolicy) HasRetention() bool {
+	return p.MaxEntries > 0 || p.MaxAge > 0
+}
+
+// Get matcher of events that should be deleted by the retention policy:
+// older than max age, or older than the newest max entries events
+func (p LogPolicy) Expired(events []Event) func(Event) bool {
+	var cutoff time.Time
+	if p.MaxAge > 0 {
+		cutoff = clock.Now().Add(-p.MaxAge)
+	}
+	if p.MaxEntries > 0 && len(events) > p.MaxEntries {
+		times := list.Map(events, func(e Event) time.Time {
+			return e.Time
+		})
+		slices.SortFunc(times, func(t1, t2 time.Time) int {
+			return t2.Compare(t1)
+		})
+		// Events with same time as the last kept event are also kept
+		if oldest := times[p.MaxEntries-1]; oldest.After(cutoff) {
+			cutoff = oldest
+		}
+	}
+	return func(e Event) bool {
+		return e.Time.Before(cutoff)
+	}
+}
+
+// Append-only event log, stored as JSON Lines (one event per line)
+type EventLog struct {
+	Path     string
+	Policy   LogPolicy
+	retained atomic.Bool // retention policy was applied by this process
+}
+
+// Append events to the log, rotating the log file if needed
+func (l *EventLog) Append(events ...Event) error {
+	var data bytes.Buffer
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return wrapErr("failed to encode event", err)
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+	return withFileLock(l.Path, func() error {
+		rotated, err := l.rotate()
+		if err != nil {
+			return wrapErr("failed to rotate logs", err)
+		}
+		file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return wrapErr("failed to open logs", err)
+		}
+		defer file.Close()
+		// Single write, so a crash cannot interleave lines
+		if _, err = file.Write(data.Bytes()); err != nil {
+			return wrapErr("failed to write logs", err)
+		}
+		if err = file.Sync(); err != nil {
+			return err
+		}
+		// Retention reads all logs, so it is applied on rotation and on the first append of the process only
+		if l.Policy.HasRetention() && (rotated || !l.retained.Swap(true)) {
+			_, err = l.applyRetention()
+		}
+		return err
+	})
+}
+
+// Delete events that match, returns deleted events
+func (l *EventLog) Delete(match func(Event) bool) ([]Event, error) {
+	var deleted []Event
+	err := withFileLock(l.Path, func() error {
+		events, err := l.readAll()
+		if err != nil {
+			return err
+		}
+		deleted, err = l.deleteEvents(events, match)
+		return err
+	})
+	return deleted, err
+}
+
+// Delete events by the retention policy (caller holds the file lock)
+func (l *EventLog) applyRetention() ([]Event, error) {
+	events, err := l.readAll()
+	if err != nil {
+		return nil, err
+	}
+	return l.deleteEvents(events, l.Policy.Expired(events))
+}
+
+// Delete matching events (caller holds the file lock): remaining events are
+// compacted into the current log file, written atomically, and rotated files are deleted
+func (l *EventLog) deleteEvents(events []Event, match func(Event) bool) ([]Event, error) {
+	deleted := list.Filter(events, match)
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+	var data bytes.Buffer
+	for _, event := range events {
+		if match(event) {
+			continue
+		}
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, wrapErr("failed to encode event", err)
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+	if err := writeFileAtomic(l.Path, data.Bytes()); err != nil {
+		return nil, wrapErr("failed to write logs", err)
+	}
+	for _, path := range l.rotatedPaths() {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// Read all events, oldest first (rotated log files, then current log file)
+func (l *EventLog) ReadAll() ([]Event, error) {
+	var events []Event
+	err := withFileLock(l.Path, func() error {
+		var err error
+		events, err = l.readAll()
+		return err
+	})
+	return events, err
+}
+
+// Read all events (caller holds the file lock)
+func (l *EventLog) readAll() ([]Event, error) {
+	events := make([]Event, 0)
+	paths := l.rotatedPaths()
+	slices.Reverse(paths)
+	paths = append(paths, l.Path)
+	for _, path := range paths {
+		fileEvents, err := readEvents(path)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, fileEvents...)
+	}
+	return events, nil
+}
+
+// Delete all log files, and progress of active transfers
+func (l *EventLog) Remove() error {
+	paths := append(l.rotatedPaths(), l.Path, l.Path+".lock")
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(l.ProgressDir())
+}
+
+// Rotate current log file if it reached max size: logs => logs.1 => logs.2 ...
+// Returns true if the log file was rotated
+func (l *EventLog) rotate() (bool, error) {
+	info, err := os.Stat(l.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if l.Policy.MaxSize <= 0 || info.Size() < l.Policy.MaxSize {
+		return false, nil
+	}
+	rotated := l.rotatedPaths()
+	// Delete rotated files beyond retention limit
+	for i := len(rotated); i >= max(l.Policy.MaxFiles, 1); i-- {
+		if err = os.Remove(rotated[i-1]); err != nil {
+			return false, err
+		}
+	}
+	if l.Policy.MaxFiles <= 0 {
+		return true, os.Remove(l.Path)
+	}
+	// Shift rotated files, then current log file becomes logs.1
+	for i := min(len(rotated), l.Policy.MaxFiles-1); i >= 1; i-- {
+		if err = os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil {
+			return false, err
+		}
+	}
+	return true, os.Rename(l.Path, l.rotatedPath(1))
+}
+
+// Path of rotated log file, 1 = most recent
+func (l *EventLog) rotatedPath(index int) string {
+	return fmt.Sprintf("%s.%d", l.Path, index)
+}
+
+// Existing rotated log file paths, most recent first
+func (l *EventLog) rotatedPaths() []string {
+	paths := make([]string, 0)
+	for i := 1; ; i++ {
+		path := l.rotatedPath(i)
+		if _, err := os.Stat(path); err != nil {
+			return paths
+		}
+		paths = append(paths, path)
+	}
+}
+
+// Read events from JSON Lines file, skipping malformed lines
+func readEvents(path string) ([]Event, error) {
+	events, _, err := readEventsFrom(path, 0)
+	return events, err
+}
+
+// Read events from JSON Lines file, starting at offset. Returns number of bytes consumed
+// (complete lines only, so a line still being written is read on the next call)
+func readEventsFrom(path string, offset int64) ([]Event, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, wrapErr("failed to open logs", err)
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, wrapErr("failed to read logs", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, wrapErr("failed to read logs", err)
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	events := make([]Event, 0)
+	for line := range bytes.Lines(data[:end]) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			continue // skip torn or corrupted line
+		}
+		events = append(events, event)
+	}
+	return events, int64(end), nil
+}
+
+// Follows events appended to the log, tail -f style
+type logTail struct {
+	log      *EventLog
+	info     os.FileInfo
+	offset   int64
+	lastTime time.Time // time of newest event seen
+}
+
+// Start following the log from its current end
+func (l *EventLog) Tail() *logTail {
+	tail := &logTail{log: l, lastTime: clock.Now()}
+	if info, err := os.Stat(l.Path); err == nil {
+		tail.info, tail.offset = info, info.Size()
+	}
+	return tail
+}
+
+// Read events appended since the last call
+func (t *logTail) Next() ([]Event, error) {
+	info, err := os.Stat(t.log.Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	events := make([]Event, 0)
+	compacted := false
+	if t.info != nil && (info == nil || !os.SameFile(t.info, info) || info.Size() < t.offset) {
+		rotated, err := os.Stat(t.log.rotatedPath(1))
+		if err == nil && os.SameFile(t.info, rotated) {
+			// Log was rotated: read the rest of the rotated file, then the new file from start
+			rest, _, err := readEventsFrom(t.log.rotatedPath(1), t.offset)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, rest...)
+		} else {
+			// Log was rewritten (pruned): read the new file from start, skipping seen events
+			compacted = true
+		}
+		t.offset = 0
+	}
+	t.info = info
+	if info != nil && info.Size() > t.offset {
+		newEvents, consumed, err := readEventsFrom(t.log.Path, t.offset)
+		if err != nil {
+			return nil, err
+		}
+		t.offset += consumed
+		if compacted {
+			newEvents = list.Filter(newEvents, func(e Event) bool {
+				return e.Time.After(t.lastTime)
+			})
+		}
+		events = append(events, newEvents...)
+	}
+	for _, e := range events {
+		if e.Time.After(t.lastTime) {
+			t.lastTime = e.Time
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,43 @@
+package dali
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionOncePerProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logsPath)
+	policy := LogPolicy{MaxSize: defaultLogMaxSize, MaxFiles: defaultLogMaxFiles, MaxEntries: 2}
+	countAfterAppends := func(events *EventLog, n int) int {
+		t.Helper()
+		for i := range n {
+			event := newEvent(actionSend, fmt.Sprintf("/tmp/file%d.txt", i), uint64(i), EventPeer{}, EventPeer{})
+			event.Time = event.Time.Add(time.Duration(i) * time.Second)
+			if err := events.Append(event); err != nil {
+				t.Fatalf("failed to append: %v", err)
+			}
+		}
+		all, err := events.ReadAll()
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		return len(all)
+	}
+
+	// Retention is only applied on the first append of the process
+	if n := countAfterAppends(&EventLog{Path: path, Policy: policy}, 5); n != 5 {
+		t.Fatalf("expected 5 logs, got %d", n)
+	}
+	if n := countAfterAppends(&EventLog{Path: path, Policy: policy}, 1); n != 2 {
+		t.Fatalf("expected 2 logs after next process, got %d", n)
+	}
+	// Retention is applied on rotation
+	policy.MaxSize = 1
+	events := &EventLog{Path: path, Policy: policy}
+	events.retained.Store(true)
+	if n := countAfterAppends(events, 3); n > 2 {
+		t.Fatalf("expected at most 2 logs after rotation, got %d", n)
+	}
+}
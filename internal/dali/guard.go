@@ -0,0 +1,203 @@
+package dali
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/dict"
+)
+
+const (
+	queryRate     float64 = 2  // Queries per second allowed per source IP
+	queryBurst    float64 = 10 // Max burst of queries per source IP
+	maxBuckets    int     = 1024
+	bucketIdleTTL         = time.Minute
+	statsInterval         = 30 * time.Second
+	maxQueryAge           = time.Minute // Max clock difference for queries in hidden mode
+)
+
+// Reasons for dropping discovery packets
+const (
+	dropInvalid    string = "invalid"
+	dropNotQuery   string = "not query"
+	dropSelf       string = "own address"
+	dropNotAllow   string = "not allowed"
+	dropRateLimit  string = "rate limited"
+	dropHidden     string = "hidden"
+	dropRelayed    string = "already relayed"
+	dropLegacyCopy string = "legacy copy"
+)
+
+// Token bucket for rate limiting a source IP
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Guards the discovery listener: rate limits, allowlist, and traffic stats
+type discoveryGuard struct {
+	mu       sync.Mutex
+	ownIP    string
+	allow    []*net.IPNet
+	buckets  map[string]*bucket
+	debug    bool
+	hidden   bool   // only answer queries with token proof or from paired contacts
+	token    string // shared token for hidden mode
+	action   string // action done for accepted queries (answered, relayed)
+	received int
+	answered int
+	dropped  dict.Counter[string]
+}
+
+// Create new discoveryGuard, with allowlist of subnets (CIDR)
+func newDiscoveryGuard(ownIP string, allow []string, debug bool) (*discoveryGuard, error) {
+	subnets := make([]*net.IPNet, 0, len(allow))
+	for _, cidr := range allow {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, wrapErr(fmt.Sprintf("invalid allowed subnet %q", cidr), err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	guard := &discoveryGuard{
+		ownIP:   ownIP,
+		allow:   subnets,
+		buckets: make(map[string]*bucket),
+		debug:   debug,
+		action:  "answered",
+		dropped: make(dict.Counter[string]),
+	}
+	return guard, nil
+}
+
+// Check if packet from source IP can be processed, returns drop reason if not
+func (g *discoveryGuard) Check(ip net.IP) (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received += 1
+
+	source := ip.String()
+	if source == g.ownIP {
+		return false, dropSelf
+	}
+
+	if len(g.allow) > 0 && !slices.ContainsFunc(g.allow, func(subnet *net.IPNet) bool {
+		return subnet.Contains(ip)
+	}) {
+		return false, dropNotAllow
+	}
+
+	// Token bucket rate limit, per source IP
+	now := time.Now()
+	b, ok := g.buckets[source]
+	if !ok {
+		g.pruneBuckets(now)
+		b = &bucket{tokens: queryBurst, lastSeen: now}
+		g.buckets[source] = b
+	}
+	b.tokens = min(queryBurst, b.tokens+now.Sub(b.lastSeen).Seconds()*queryRate)
+	b.lastSeen = now
+	if b.tokens < 1 {
+		return false, dropRateLimit
+	}
+	b.tokens -= 1
+	return true, ""
+}
+
+// Check if query can be answered (in hidden mode, needs token proof or paired contact)
+func (g *discoveryGuard) CheckQuery(msg *DiscoveryMessage, contacts map[string]Contact) (bool, string) {
+	if !g.hidden || canQueryHidden(msg, g.token, contacts) {
+		return true, ""
+	}
+	return false, dropHidden
+}
+
+// Check if hidden node can answer query (or ping): recent, and has token proof or is signed by paired contact
+func canQueryHidden(msg *DiscoveryMessage, token string, contacts map[string]Contact) bool {
+	age := time.Since(time.Unix(msg.Time, 0)).Abs()
+	if age > maxQueryAge {
+		return false // stale or replayed query
+	}
+	if msg.HasTokenProof(token) {
+		return true
+	}
+	contact, ok := contacts[msg.ID]
+	return ok && contact.Key != "" && contact.Key == msg.PubKey && msg.Verify() // signed by paired contact
+}
+
+// Check if hidden node can answer offer (or text message): the sender's query must pass canQueryHidden
+func canOfferHidden(offer *TransferMessage, token string, contacts map[string]Contact) bool {
+	return offer.Query != nil && offer.Query.ID == offer.SenderID && canQueryHidden(offer.Query, token, contacts)
+}
+
+// Remove idle buckets if there are too many tracked sources. If none are idle
+// (e.g. flood from spoofed addresses), evict the least recently seen bucket
+func (g *discoveryGuard) pruneBuckets(now time.Time) {
+	if len(g.buckets) < maxBuckets {
+		return
+	}
+	oldestSource, oldest := "", now
+	for source, b := range g.buckets {
+		if now.Sub(b.lastSeen) > bucketIdleTTL {
+			delete(g.buckets, source)
+		} else if b.lastSeen.Before(oldest) || oldestSource == "" {
+			oldestSource, oldest = source, b.lastSeen
+		}
+	}
+	if len(g.buckets) >= maxBuckets {
+		delete(g.buckets, oldestSource)
+	}
+}
+
+// Record dropped packet
+func (g *discoveryGuard) Drop(addr *net.UDPAddr, reason string) {
+	g.mu.Lock()
+	g.dropped[reason] += 1
+	g.mu.Unlock()
+	if g.debug {
+		fmt.Printf("[discovery] %s dropped packet from %s: %s\n", clock.TimeNow(), addr, reason)
+	}
+}
+
+// Record answered (or relayed) query
+func (g *discoveryGuard) Answer(addr *net.UDPAddr) {
+	g.mu.Lock()
+	g.answered += 1
+	g.mu.Unlock()
+	if g.debug {
+		fmt.Printf("[discovery] %s %s query from %s\n", clock.TimeNow(), g.action, addr)
+	}
+}
+
+// Summary of discovery traffic stats
+func (g *discoveryGuard) String() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	total := 0
+	reasons := make([]string, 0, len(g.dropped))
+	for _, entry := range dict.SortedEntries(g.dropped) {
+		reason, count := entry.Tuple()
+		total += count
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+	}
+	out := fmt.Sprintf("received=%d %s=%d dropped=%d", g.received, g.action, g.answered, total)
+	if len(reasons) > 0 {
+		out += fmt.Sprintf(" (%s)", strings.Join(reasons, ", "))
+	}
+	return out
+}
+
+// Print discovery traffic stats periodically, if debug is on
+func (g *discoveryGuard) ReportStats() {
+	if !g.debug {
+		return
+	}
+	for range time.Tick(statsInterval) {
+		fmt.Printf("[discovery] %s stats: %s\n", clock.TimeNow(), g)
+	}
+}
@@ -0,0 +1,30 @@
+package dali
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGuardBucketsCapped(t *testing.T) {
+	guard, err := newDiscoveryGuard("10.0.0.1", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Flood of queries from distinct (spoofed) sources, none idle
+	numSources := 4 * maxBuckets
+	for i := range numSources {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i))
+		if ok, reason := guard.Check(ip); !ok {
+			t.Fatalf("first query from %s dropped: %s", ip, reason)
+		}
+	}
+	if len(guard.buckets) > maxBuckets {
+		t.Fatalf("expected at most %d buckets, got %d", maxBuckets, len(guard.buckets))
+	}
+	// Most recent source is still tracked and rate limited
+	i := numSources - 1
+	last := net.IPv4(10, 1, byte(i>>8), byte(i))
+	if _, ok := guard.buckets[last.String()]; !ok {
+		t.Fatalf("most recent source %s was evicted", last)
+	}
+}
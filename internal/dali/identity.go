@@ -0,0 +1,332 @@
+package dali
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/roidaradal/fn/str"
+)
+
+// Number of public key hash bytes used for the node ID
+const idLength int = 8
+
+// Peer verification status
+const (
+	statusTrusted  string = "trusted"  // valid signature, key matches known contact
+	statusVerified string = "verified" // valid signature, not a known contact
+	statusUnknown  string = "unknown"  // unsigned or invalid signature
+	statusChanged  string = "changed"  // valid signature, but name belongs to contact with another key
+	statusRelayed  string = "relayed"  // valid signature, but reached via unverified relay proxy address
+)
+
+var statusColor = map[string]func(string) string{
+	statusTrusted:  str.Green,
+	statusVerified: str.Cyan,
+	statusUnknown:  str.Yellow,
+	statusChanged:  str.Red,
+	statusRelayed:  str.Yellow,
+}
+
+// Known peer identity, keyed by node ID in Config.Contacts
+type Contact struct {
+	Name string
+	Addr string
+	Key  string `json:",omitempty"` // public key, if learned from verified announce
+}
+
+// Generate new identity key, returns node ID and base64-encoded private key
+func newIdentity() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", wrapErr("failed to generate identity key", err)
+	}
+	key := base64.StdEncoding.EncodeToString(privateKey.Seed())
+	return fingerprint(publicKey), key, nil
+}
+
+// Compute node ID from public key (hex of public key hash prefix)
+func fingerprint(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:idLength])
+}
+
+// Check if node ID matches the given ID or ID prefix
+func matchesID(id, target string) bool {
+	if id == "" || target == "" {
+		return false
+	}
+	return strings.HasPrefix(id, strings.ToLower(target))
+}
+
+// Initialize node identity if missing, returns true if identity was created
+func (c *Config) InitIdentity() (bool, error) {
+	if c.ID != "" && c.Key != "" {
+		return false, nil
+	}
+	id, key, err := newIdentity()
+	if err != nil {
+		return false, err
+	}
+	c.ID, c.Key = id, key
+	return true, nil
+}
+
+// Node identity, copied from config so it is safe to use during concurrent config updates
+type Identity struct {
+	ID   string
+	Name string
+	Key  string // private key seed, base64
+}
+
+// Get snapshot of node identity
+func (c *Config) Identity() Identity {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Identity{ID: c.ID, Name: c.Name, Key: c.Key}
+}
+
+// Decode node's private key
+func (c *Config) SigningKey() (ed25519.PrivateKey, error) {
+	return c.Identity().SigningKey()
+}
+
+// Decode private key of identity
+func (id Identity) SigningKey() (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(id.Key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, wrapErr("invalid identity key", err)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Sign transfer message with identity key, left unsigned if the key is invalid
+func (id Identity) Sign(msg *TransferMessage) {
+	if key, err := id.SigningKey(); err == nil {
+		msg.Sign(key)
+	}
+}
+
+// Add or update contact info of peer, key is only set if peer was verified
+func (c *Config) AddContact(id, name, addr, key string) {
+	if id == "" || id == c.ID {
+		return
+	}
+	old := c.Contacts[id]
+	if old.Key != "" && key != old.Key {
+		return // verified contact can only be updated by the same key
+	}
+	if addr == "" {
+		// Keep last known address
+		addr = old.Addr
+	}
+	if key == "" {
+		key = old.Key
+	}
+	// Copy-on-write, so readers of the old contacts map are not disturbed
+	contacts := maps.Clone(c.Contacts)
+	if contacts == nil {
+		contacts = make(map[string]Contact)
+	}
+	contacts[id] = Contact{Name: name, Addr: addr, Key: key}
+	c.Contacts = contacts
+}
+
+// Remove contact, returns true if contact was found
+func (c *Config) RemoveContact(id string) bool {
+	if _, ok := c.Contacts[id]; !ok {
+		return false
+	}
+	// Copy-on-write, so readers of the old contacts map are not disturbed
+	contacts := maps.Clone(c.Contacts)
+	delete(contacts, id)
+	c.Contacts = contacts
+	return true
+}
+
+// Trust verified contact's key for its name: removes other verified contacts with the same name
+// (e.g. old key of a reinstalled peer), so the contact is no longer seen as changed. Returns removed IDs
+func (c *Config) TrustContact(id string) ([]string, error) {
+	contact, ok := c.Contacts[id]
+	if !ok || contact.Key == "" {
+		return nil, fmt.Errorf("contact %s has no verified key. Send or receive a file to pair with it first", id)
+	}
+	removed := make([]string, 0)
+	for otherID, other := range c.Contacts {
+		if otherID != id && other.Key != "" && strings.EqualFold(other.Name, contact.Name) {
+			removed = append(removed, otherID)
+		}
+	}
+	for _, otherID := range removed {
+		c.RemoveContact(otherID)
+	}
+	return removed, nil
+}
+
+// Find ID of contact with the given ID or ID prefix
+func (c *Config) FindContactID(target string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0)
+	for id := range c.Contacts {
+		if matchesID(id, target) {
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("contact %q not found", target)
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("%q matches %d contacts: %s", target, len(ids), strings.Join(ids, ", "))
+}
+
+// Find IDs of contacts with the given name
+func (c *Config) ContactIDs(name string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0)
+	for id, contact := range c.Contacts {
+		if strings.EqualFold(contact.Name, name) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Compute verification status of peer announce, based on known contacts
+func peerStatus(contacts map[string]Contact, msg *DiscoveryMessage) string {
+	if !msg.Verify() {
+		return statusUnknown
+	}
+	if msg.Via != "" {
+		return statusRelayed // relay proxy address is not covered by signature
+	}
+	if contact, ok := contacts[msg.ID]; ok && contact.Key == msg.PubKey {
+		return statusTrusted
+	}
+	for id, contact := range contacts {
+		if id != msg.ID && contact.Key != "" && strings.EqualFold(contact.Name, msg.Name) {
+			return statusChanged // another key is known for this name
+		}
+	}
+	return statusVerified
+}
+
+// Check if peer is an unverified impostor of a known contact
+func (c *Config) IsImpostor(peer Peer) bool {
+	switch peer.Status {
+	case statusChanged:
+		return true
+	case statusUnknown, statusRelayed:
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for id, contact := range c.Contacts {
+			if contact.Key != "" && (id == peer.ID || strings.EqualFold(contact.Name, peer.Name)) {
+				return true // unverified peer claims ID or name of verified contact
+			}
+		}
+	}
+	return false
+}
+
+// Compute token proof for query: HMAC of nonce and time, keyed by shared token
+func tokenProof(token, nonce string, unixTime int64) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%s|%d", nonce, unixTime)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check if query carries valid proof of the shared token
+func (m *DiscoveryMessage) HasTokenProof(token string) bool {
+	if token == "" || m.Proof == "" {
+		return false
+	}
+	expected := tokenProof(token, m.Nonce, m.Time)
+	return hmac.Equal([]byte(m.Proof), []byte(expected))
+}
+
+// Get base64-encoded public key of private key
+func encodePublicKey(privateKey ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+}
+
+// Sign payload with private key, returns base64-encoded signature
+func signPayload(privateKey ed25519.PrivateKey, payload []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload))
+}
+
+// Verify payload signature, and that the ID is the fingerprint of the public key
+func verifyPayload(id, pubKey, sig string, payload []byte) bool {
+	if pubKey == "" || sig == "" {
+		return false
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	if fingerprint(publicKey) != id {
+		return false
+	}
+	return ed25519.Verify(publicKey, payload, signature)
+}
+
+// Sign announce or query with private key, sets PubKey and Sig
+func (m *DiscoveryMessage) Sign(privateKey ed25519.PrivateKey) {
+	m.PubKey = encodePublicKey(privateKey)
+	m.Sig = signPayload(privateKey, m.signedBytes())
+}
+
+// Verify announce or query signature
+func (m *DiscoveryMessage) Verify() bool {
+	return verifyPayload(m.ID, m.PubKey, m.Sig, m.signedBytes())
+}
+
+// Bytes covered by announce signature: JSON of message without signature and relay fields
+func (m *DiscoveryMessage) signedBytes() []byte {
+	msg := *m
+	msg.Sig = ""
+	msg.Truncated = false
+	msg.Hops, msg.Via = 0, ""
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// Sign offer with private key, sets PubKey and Sig
+func (m *TransferMessage) Sign(privateKey ed25519.PrivateKey) {
+	m.PubKey = encodePublicKey(privateKey)
+	m.Sig = signPayload(privateKey, m.signedBytes())
+}
+
+// Verify offer signature
+func (m *TransferMessage) Verify() bool {
+	return verifyPayload(m.SenderID, m.PubKey, m.Sig, m.signedBytes())
+}
+
+// Check if pong is signed by the announced peer and echoes the query (not a replayed pong)
+func (m *TransferMessage) AnswersQuery(query *DiscoveryMessage) bool {
+	if m.Query == nil || query == nil || m.Query.Nonce != query.Nonce || m.Announce == nil {
+		return false
+	}
+	return m.SenderID == m.Announce.ID && m.Verify()
+}
+
+// Bytes covered by offer signature: JSON of message without signature
+func (m *TransferMessage) signedBytes() []byte {
+	msg := *m
+	msg.Sig = ""
+	data, _ := json.Marshal(msg)
+	return data
+}
@@ -0,0 +1,20 @@
+package dali
+
+import (
+	"os"
+)
+
+// Run fn while holding an exclusive advisory lock on path (via path.lock),
+// to coordinate writes across goroutines and dali processes
+func withFileLock(path string, fn func() error) error {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return wrapErr("failed to open lock file", err)
+	}
+	defer file.Close()
+	if err = lockFile(file); err != nil {
+		return wrapErr("failed to lock file", err)
+	}
+	defer unlockFile(file)
+	return fn()
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package dali
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Acquire exclusive advisory lock on file, blocks until available
+func lockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_EX)
+}
+
+// Release advisory lock on file
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package dali
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Acquire exclusive lock on file, blocks until available
+func lockFile(file *os.File) error {
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, new(windows.Overlapped))
+}
+
+// Release lock on file
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, new(windows.Overlapped))
+}
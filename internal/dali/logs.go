@@ -0,0 +1,363 @@
+package dali
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/dict"
+	"github.com/roidaradal/fn/lang"
+	"github.com/roidaradal/fn/list"
+	"github.com/roidaradal/fn/str"
+)
+
+// Log export formats
+const (
+	formatCSV   string = "csv"
+	formatJSON  string = "json"
+	formatJSONL string = "jsonl"
+)
+
+var logFormats = []string{formatCSV, formatJSON, formatJSONL}
+
+// Number of last logs shown before following new logs
+const defaultFollowLimit int = 10
+
+// Max length of message text shown in log line
+const maxMessagePreview int = 40
+
+// CSV columns of exported logs
+var csvHeader = []string{
+	"time", "action", "result", "path", "size_bytes", "duration_secs", "throughput_bps",
+	"sender_name", "sender_id", "sender_addr", "receiver_name", "receiver_id", "receiver_addr",
+	"checksum", "error", "kind", "text", "reason", "note", "saved_as", "id",
+}
+
+// Log sort orders
+const (
+	sortAsc  string = "asc"  // oldest first
+	sortDesc string = "desc" // newest first
+	sortSize string = "size" // largest first
+)
+
+var logSortOrders = []string{sortAsc, sortDesc, sortSize}
+
+// Filter for event logs, empty fields match anything
+type logFilter struct {
+	date    string
+	action  string
+	result  string
+	from    string
+	to      string
+	peer    string
+	file    *regexp.Regexp
+	since   time.Time
+	until   time.Time
+	minSize uint64
+	maxSize uint64
+}
+
+// Create logFilter from command options: date=DATE, since=TIME, until=TIME, action=ACTION, result=RESULT,
+// from=NAME|ID, to=NAME|ID, peer=NAME|ID, file=FILENAME_SUBSTRING, min=SIZE, max=SIZE
+func newLogFilter(options dict.StringMap) (*logFilter, error) {
+	filter := &logFilter{}
+	for k, v := range options {
+		if v == "" {
+			continue
+		}
+		switch k {
+		case "date":
+			filter.date = v
+		case "since", "until":
+			bound, err := parseTimeBound(v, k == "until")
+			if err != nil {
+				return nil, err
+			}
+			if k == "since" {
+				filter.since = bound
+			} else {
+				filter.until = bound
+			}
+		case "action":
+			filter.action = strings.ToLower(v)
+		case "result":
+			filter.result = strings.ToLower(v)
+		case "peer":
+			filter.peer = strings.ToLower(v)
+		case "min", "max":
+			size, ok := parseFileSize(v)
+			if !ok {
+				return nil, fmt.Errorf("invalid file size %q", v)
+			}
+			if k == "min" {
+				filter.minSize = uint64(size)
+			} else {
+				filter.maxSize = uint64(size)
+			}
+		case "from":
+			filter.from = strings.ToLower(v)
+		case "to":
+			filter.to = strings.ToLower(v)
+		case "file":
+			pattern, err := regexp.Compile("(?i)" + v)
+			if err != nil {
+				return nil, wrapErr(fmt.Sprintf("invalid file pattern %q", v), err)
+			}
+			filter.file = pattern
+		}
+	}
+	return filter, nil
+}
+
+// Check if event passes the filter
+func (f *logFilter) Match(e Event) bool {
+	if f.date != "" && clock.DateFormat(e.Time) != f.date {
+		return false
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && e.Time.After(f.until) {
+		return false
+	}
+	if f.action != "" && string(e.Action) != f.action {
+		return false
+	}
+	if f.result != "" && string(e.Result) != f.result {
+		return false
+	}
+	if f.peer != "" && !e.Sender.Matches(f.peer) && !e.Receiver.Matches(f.peer) {
+		return false
+	}
+	if e.Size < f.minSize || (f.maxSize > 0 && e.Size > f.maxSize) {
+		return false
+	}
+	if f.from != "" && !e.Sender.Matches(f.from) {
+		return false
+	}
+	if f.to != "" && !e.Receiver.Matches(f.to) {
+		return false
+	}
+	if f.file != nil && !f.file.MatchString(e.Path) {
+		return false
+	}
+	return true
+}
+
+// Sort events in place by sort order (asc, desc, size)
+func sortEvents(events []Event, order string) error {
+	switch order {
+	case sortAsc:
+		slices.SortStableFunc(events, func(e1, e2 Event) int {
+			return e1.Time.Compare(e2.Time)
+		})
+	case sortDesc:
+		slices.SortStableFunc(events, func(e1, e2 Event) int {
+			return e2.Time.Compare(e1.Time)
+		})
+	case sortSize:
+		slices.SortStableFunc(events, func(e1, e2 Event) int {
+			return cmp.Or(cmp.Compare(e2.Size, e1.Size), e2.Time.Compare(e1.Time))
+		})
+	default:
+		return fmt.Errorf("invalid sort order %q, use one of: %s", order, strings.Join(logSortOrders, ", "))
+	}
+	return nil
+}
+
+// Parse time bound: relative age (e.g. 7d, 12h), date (yyyy-mm-dd), or RFC 3339 time.
+// Date as upper bound includes the whole day
+func parseTimeBound(text string, upper bool) (time.Time, error) {
+	if age, ok := parseAge(text); ok {
+		return clock.Now().Add(-age), nil
+	}
+	if date, err := time.ParseInLocation(time.DateOnly, text, clock.CurrentTimezone()); err == nil {
+		if upper {
+			date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return date, nil
+	}
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use age (e.g. 7d, 12h), date (yyyy-mm-dd), or RFC 3339 time", text)
+}
+
+// Display events as log lines, with aligned sender and receiver names
+func displayEvents(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	fromMaxLength := slices.Max(list.Map(events, func(e Event) int {
+		return len(e.Sender.Name)
+	}))
+	toMaxLength := slices.Max(list.Map(events, func(e Event) int {
+		return len(e.Receiver.Name)
+	}))
+	for _, e := range events {
+		fmt.Print(eventLine(e, fromMaxLength, toMaxLength))
+	}
+}
+
+// Delete matching events from event log, after confirmation. On dry run, only lists events to delete
+func deleteLogs(eventLog *EventLog, events []Event, match func(Event) bool, dryRun, confirmed bool) error {
+	matched := list.Filter(events, match)
+	if len(matched) == 0 {
+		fmt.Println("No logs to remove")
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("Would remove %d of %d logs:\n", len(matched), len(events))
+		displayEvents(matched)
+		return nil
+	}
+	if !confirmed {
+		fmt.Printf("Remove %d of %d logs? [y/N]: ", len(matched), len(events))
+		if answer := strings.ToLower(readInput()); answer != "y" && answer != "yes" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+	deleted, err := eventLog.Delete(match)
+	if err != nil {
+		return wrapErr("failed to remove logs", err)
+	}
+	fmt.Printf("Removed %d logs\n", len(deleted))
+	return nil
+}
+
+// Format event as log line, with event ID, and padded sender and receiver names
+func eventLine(e Event, fromLength, toLength int) string {
+	template := fmt.Sprintf("#%%-%ds %%s %%s %%s from=%%-%ds to=%%-%ds %%7s %%s\n", 2*eventIDLength, fromLength, toLength)
+	timestamp := clock.StandardFormat(e.Time)
+	action := str.Center(string(e.Action), 8)
+	result := str.Center(string(e.Result), 7)
+	target := e.Path
+	if e.Kind == kindMessage {
+		target = fmt.Sprintf("message %q", shortenText(e.Text, maxMessagePreview))
+	}
+	if e.Result == resultReject && (e.Reason != "" || e.Note != "") {
+		target += fmt.Sprintf(" (%s)", describeReason(e.Reason, e.Note))
+	}
+	return fmt.Sprintf(template, e.ID, timestamp, action, result, e.Sender.Name, e.Receiver.Name, computeFileSize(e.Size), target)
+}
+
+// Stream new events and active transfers that pass the filter, tail -f style (until interrupted)
+func followEvents(eventLog *EventLog, filter *logFilter) error {
+	fmt.Println(str.Violet("Following logs... (Ctrl+C to stop)"))
+	tail := eventLog.Tail()
+	status := ""
+	for {
+		events, err := tail.Next()
+		if err != nil {
+			return err
+		}
+		events = list.Filter(events, filter.Match)
+		active := list.Filter(eventLog.ActiveTransfers(), func(p TransferProgress) bool {
+			return filter.Match(p.Event)
+		})
+		slices.SortFunc(active, func(p1, p2 TransferProgress) int {
+			return p1.Event.Time.Compare(p2.Event.Time)
+		})
+		newStatus := strings.Join(list.Map(active, progressLine), " | ")
+
+		// Clear status line, print new events, then redraw status line
+		if len(events) > 0 || newStatus != status {
+			fmt.Print("\r\033[K")
+			for _, e := range events {
+				fmt.Print(eventLine(e, 0, 0))
+			}
+			fmt.Print(newStatus)
+			status = newStatus
+		}
+		time.Sleep(progressInterval)
+	}
+}
+
+// Describe active transfer progress, e.g. send f.txt to bob 45.0% (1.2MB/2.6MB)
+func progressLine(p TransferProgress) string {
+	e := p.Event
+	peer := lang.Ternary(e.Action == actionSend, "to "+e.Receiver.Name, "from "+e.Sender.Name)
+	if e.Stream {
+		return fmt.Sprintf("%s %s %s %s (size unknown)", e.Action, filepath.Base(e.Path), peer, str.Cyan(computeFileSize(p.Transferred)))
+	}
+	percent := str.Cyan(fmt.Sprintf("%.1f%%", p.Percent()))
+	return fmt.Sprintf("%s %s %s %s (%s/%s)", e.Action, filepath.Base(e.Path), peer, percent, computeFileSize(p.Transferred), computeFileSize(e.Size))
+}
+
+// Check if event peer has the given name (lowercase) or ID prefix
+func (p EventPeer) Matches(nameOrID string) bool {
+	return strings.ToLower(p.Name) == nameOrID || matchesID(p.ID, nameOrID)
+}
+
+// Write events in export format (csv, json, jsonl)
+func exportEvents(w io.Writer, events []Event, format string) error {
+	switch format {
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(csvHeader)
+		for _, e := range events {
+			writer.Write(e.CSVRecord())
+		}
+		writer.Flush()
+		return writer.Error()
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(events)
+	case formatJSONL:
+		encoder := json.NewEncoder(w)
+		for _, e := range events {
+			if err := encoder.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid format %q, use one of: %s", format, strings.Join(logFormats, ", "))
+}
+
+// Event as CSV record, with RFC 3339 timestamp and sizes in bytes.
+// Text cells (peer names and notes, paths, message text) are escaped, so spreadsheets do not run them as formulas
+func (e Event) CSVRecord() []string {
+	return []string{
+		e.Time.Format(time.RFC3339),
+		string(e.Action),
+		string(e.Result),
+		csvText(e.Path),
+		strconv.FormatUint(e.Size, 10),
+		fmt.Sprintf("%.3f", e.Duration.Seconds()),
+		fmt.Sprintf("%.0f", e.Throughput),
+		csvText(e.Sender.Name),
+		e.Sender.ID,
+		e.Sender.Addr,
+		csvText(e.Receiver.Name),
+		e.Receiver.ID,
+		e.Receiver.Addr,
+		e.Checksum,
+		csvText(e.Error),
+		string(e.Kind),
+		csvText(e.Text),
+		e.Reason,
+		csvText(e.Note),
+		csvText(e.SavedAs),
+		e.ID,
+	}
+}
+
+// Escape CSV text cell that a spreadsheet would read as formula, by prefixing it with '
+func csvText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
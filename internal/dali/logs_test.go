@@ -0,0 +1,29 @@
+package dali
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestCSVFormulaEscape(t *testing.T) {
+	event := newEvent(actionReceive, "=HYPERLINK(\"http://evil\")", 5, EventPeer{Name: "@SUM(1+1)"}, EventPeer{Name: "bob"})
+	event.Kind, event.Text, event.Note = kindMessage, "+1", "-1"
+	var buf bytes.Buffer
+	if err := exportEvents(&buf, []Event{event}, formatCSV); err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("failed to read CSV: %v", err)
+	}
+	for i, column := range csvHeader {
+		cell := records[1][i]
+		if cell != "" && bytes.ContainsRune([]byte("=+-@"), rune(cell[0])) {
+			t.Errorf("column %s: formula cell %q", column, cell)
+		}
+	}
+	if record := event.CSVRecord(); record[3] != `'=HYPERLINK("http://evil")` || record[10] != "bob" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
@@ -1,40 +1,104 @@
 package dali
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/roidaradal/fn/str"
+)
+
+const (
+	queryType     string = "query"
+	announceType  string = "announce"
+	offerType     string = "offer"
+	treeOfferType string = "tree"
+	acceptType    string = "accept"
+	rejectType    string = "reject"
+	pingType      string = "ping"
+	pongType      string = "pong"
+	textType      string = "text"
+)
+
+// Reasons for accepting or rejecting transfers
 const (
-	queryType    string = "query"
-	announceType string = "announce"
-	offerType    string = "offer"
-	acceptType   string = "accept"
-	rejectType   string = "reject"
+	reasonAuto      string = "auto"
+	reasonUser      string = "user"
+	reasonDeclined  string = "declined"
+	reasonNoSpace   string = "no-space"
+	reasonTooLarge  string = "too-large"
+	reasonNotPaired string = "not-paired"
+	reasonBusy      string = "busy"
+	reasonInvalid   string = "invalid"
+	reasonFailed    string = "failed"
 )
 
+// Descriptions of accept and reject reasons
+var reasonTexts = map[string]string{
+	reasonAuto:      "auto-accepted",
+	reasonUser:      "accepted by user",
+	reasonDeclined:  "user declined",
+	reasonNoSpace:   "insufficient space on peer",
+	reasonTooLarge:  "too large for peer's max size",
+	reasonNotPaired: "not paired",
+	reasonBusy:      "peer is busy",
+	reasonInvalid:   "invalid offer",
+	reasonFailed:    "failed to save on peer",
+}
+
 type DiscoveryMessage struct {
+	Version      byte   `json:"-"` // packet version
 	Type         string // query, announce
+	ID           string // peer ID
 	Name         string // peer name (for announce)
 	Addr         string
 	TransferPort uint16 // transfer port (for announce)
+	Time         int64  `json:",omitempty"` // unix time (for query)
+	Nonce        string `json:",omitempty"` // random nonce (for query)
+	Proof        string `json:",omitempty"` // token proof: HMAC of nonce (for query)
+	PubKey       string `json:",omitempty"` // public key
+	Sig          string `json:",omitempty"` // signature of announce or query
+	Truncated    bool   `json:",omitempty"` // compact announce, full announce fetched over TCP
+	Hops         int    `json:",omitempty"` // number of relays passed
+	Via          string `json:",omitempty"` // relay proxy address to connect to (for announce)
 }
 
 type TransferMessage struct {
-	Type     string // offer, accept, reject, complete
-	Sender   string // sender name (for offer)
-	Filename string // file name (for offer)
-	Size     uint64 // file size (for offer)
+	Type     string            // offer, tree, text, accept, reject, complete, ping, pong
+	Sender   string            // message sender name
+	SenderID string            // message sender ID
+	Filename string            // file name (for offer)
+	Size     uint64            // file size (for offer)
+	Mode     uint32            `json:",omitempty"` // file permission bits (for offer)
+	ModTime  int64             `json:",omitempty"` // file modification time, unix nanoseconds (for offer)
+	Entries  []TreeEntry       `json:",omitempty"` // folder contents (for tree offer)
+	Stream   bool              `json:",omitempty"` // unknown size, data sent in frames (for offer)
+	Text     string            `json:",omitempty"` // message text (for text)
+	Reason   string            `json:",omitempty"` // reason code (for accept, reject)
+	Note     string            `json:",omitempty"` // optional text of reason (for accept, reject)
+	SavedAs  string            `json:",omitempty"` // final file name chosen by receiver (for accept)
+	Announce *DiscoveryMessage `json:",omitempty"` // full announce (for pong)
+	Query    *DiscoveryMessage `json:",omitempty"` // signed query, with optional token proof (for ping, offer, text)
+	PubKey   string            `json:",omitempty"` // sender public key (for offer)
+	Sig      string            `json:",omitempty"` // signature (for offer)
 }
 
 // Create new query DiscoveryMessage
-func newQueryMessage() *DiscoveryMessage {
+func newQueryMessage(id string) *DiscoveryMessage {
 	return &DiscoveryMessage{
-		Type: queryType,
+		Type:  queryType,
+		ID:    id,
+		Time:  time.Now().Unix(),
+		Nonce: str.RandomString(16, false, true, true),
 	}
 }
 
 // Create new announce DiscoveryMessage
-func newAnnounceMessage(name, addr string, transferPort uint16) *DiscoveryMessage {
+func newAnnounceMessage(id, name, addr string, transferPort uint16) *DiscoveryMessage {
 	return &DiscoveryMessage{
 		Type:         announceType,
+		ID:           id,
 		Name:         name,
 		Addr:         addr,
 		TransferPort: transferPort,
@@ -42,23 +106,44 @@ func newAnnounceMessage(name, addr string, transferPort uint16) *DiscoveryMessag
 }
 
 // Create new offer TransferMessage
-func newOfferMessage(sender, filename string, size uint64) *TransferMessage {
+func newOfferMessage(senderID, sender, filename string, size uint64) *TransferMessage {
 	return &TransferMessage{
 		Type:     offerType,
 		Sender:   sender,
+		SenderID: senderID,
 		Filename: filename,
 		Size:     size,
 	}
 }
 
+// Create new text TransferMessage
+func newTextMessage(senderID, sender, text string) *TransferMessage {
+	return &TransferMessage{Type: textType, Sender: sender, SenderID: senderID, Text: text}
+}
+
 // Create new accept TransferMessage
-func newAcceptMessage() *TransferMessage {
-	return &TransferMessage{Type: acceptType}
+func newAcceptMessage(senderID, sender string) *TransferMessage {
+	return &TransferMessage{Type: acceptType, Sender: sender, SenderID: senderID}
 }
 
 // Create new reject TransferMessage
-func newRejectMessage() *TransferMessage {
-	return &TransferMessage{Type: rejectType}
+func newRejectMessage(senderID, sender string) *TransferMessage {
+	return &TransferMessage{Type: rejectType, Sender: sender, SenderID: senderID}
+}
+
+// Create new ping TransferMessage
+func newPingMessage(query *DiscoveryMessage) *TransferMessage {
+	return &TransferMessage{Type: pingType, Query: query}
+}
+
+// Create new pong TransferMessage, with full announce
+func newPongMessage(announce *DiscoveryMessage) *TransferMessage {
+	return &TransferMessage{
+		Type:     pongType,
+		Sender:   announce.Name,
+		SenderID: announce.ID,
+		Announce: announce,
+	}
 }
 
 // Deserialize (DiscoveryMessage|TransferMessage) from JSON bytes
@@ -71,10 +156,24 @@ func parseMessage[T any](data []byte) (*T, error) {
 	return &msg, nil
 }
 
-// Serialize DiscoveryMessage to JSON bytes
-func (m *DiscoveryMessage) ToBytes() []byte {
-	data, _ := json.Marshal(m)
-	return data
+// Get reason (with note) as error, nil if there is no reason
+func (m *TransferMessage) ReasonError() error {
+	if m.Reason == "" && m.Note == "" {
+		return nil
+	}
+	return errors.New(describeReason(m.Reason, m.Note))
+}
+
+// Describe reason code, with optional note
+func describeReason(reason, note string) string {
+	text := reason
+	if description, ok := reasonTexts[reason]; ok {
+		text = description
+	}
+	if note == "" {
+		return text
+	}
+	return strings.TrimPrefix(text+": ", ": ") + sanitizeText(note)
 }
 
 // Serialize TransferMessage to JSON bytes with newline
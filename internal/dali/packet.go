@@ -0,0 +1,98 @@
+package dali
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Discovery packet format: magic (4 bytes) + version (1 byte) + JSON-encoded DiscoveryMessage
+// Legacy packets (version 0) are plain JSON, sent by dali v0.1.4 and older
+const (
+	packetMagic   string = "DALI"
+	packetVersion byte   = 1
+	legacyVersion byte   = 0
+	headerSize    int    = len(packetMagic) + 1
+	maxPacketSize int    = 1200  // Max discovery packet size, fits in one unfragmented UDP datagram
+	readBufSize   int    = 65535 // Max UDP datagram size, so oversized packets are detected instead of truncated
+)
+
+var (
+	errPacketTooLarge = errors.New("packet too large")
+	errPacketTooShort = errors.New("packet too short")
+	errBadMagic       = errors.New("not a dali packet")
+	errUnknownVersion = errors.New("unsupported packet version")
+	errMissingType    = errors.New("missing message type")
+)
+
+// Serialize DiscoveryMessage to packet bytes of given version
+func (m *DiscoveryMessage) ToPacket(version byte) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if version == legacyVersion {
+		data = body
+	} else {
+		data = make([]byte, 0, headerSize+len(body))
+		data = append(data, packetMagic...)
+		data = append(data, version)
+		data = append(data, body...)
+	}
+	if len(data) > maxPacketSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", errPacketTooLarge, len(data), maxPacketSize)
+	}
+	return data, nil
+}
+
+// Deserialize DiscoveryMessage from packet bytes, sets the message Version
+func parsePacket(data []byte) (*DiscoveryMessage, error) {
+	if len(data) > maxPacketSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", errPacketTooLarge, len(data), maxPacketSize)
+	}
+
+	version, body := legacyVersion, data
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		// Not legacy JSON: check packet header
+		if len(data) < headerSize {
+			return nil, errPacketTooShort
+		}
+		if string(data[:len(packetMagic)]) != packetMagic {
+			return nil, errBadMagic
+		}
+		version, body = data[len(packetMagic)], data[headerSize:]
+		if version != packetVersion {
+			return nil, fmt.Errorf("%w: %d", errUnknownVersion, version)
+		}
+	}
+
+	msg, err := parseMessage[DiscoveryMessage](body)
+	if err != nil {
+		return nil, wrapErr("invalid packet body", err)
+	}
+	if msg.Type == "" {
+		return nil, errMissingType
+	}
+	msg.Version = version
+	return msg, nil
+}
+
+// Create compact announce that fits in a packet, full announce is fetched over TCP
+func (m *DiscoveryMessage) Compact() *DiscoveryMessage {
+	return &DiscoveryMessage{
+		Type:         m.Type,
+		ID:           m.ID,
+		Addr:         m.Addr,
+		TransferPort: m.TransferPort,
+		Truncated:    true,
+	}
+}
+
+// Check if message is the legacy copy of a versioned query: new clients send both,
+// so that dali v0.1.4 and older can answer. Legacy clients do not send a nonce
+func (m *DiscoveryMessage) IsLegacyCopy() bool {
+	return m.Version == legacyVersion && m.Type == queryType && m.Nonce != ""
+}
@@ -0,0 +1,124 @@
+package dali
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParsePacket(t *testing.T) {
+	query := []byte(`{"Type":"query","ID":"abc"}`)
+	tests := []struct {
+		name    string
+		data    []byte
+		version byte
+		fails   bool
+		err     error // expected error, if any error is not enough
+	}{
+		{"empty", []byte{}, 0, true, errPacketTooShort},
+		{"short", []byte("DAL"), 0, true, errPacketTooShort},
+		{"header only", []byte(packetMagic + "\x01"), 0, true, nil},
+		{"bad magic", append([]byte("DAL1\x01"), query...), 0, true, errBadMagic},
+		{"unknown version", append([]byte(packetMagic+"\x02"), query...), 0, true, errUnknownVersion},
+		{"too large", append([]byte(packetMagic+"\x01"), bytes.Repeat([]byte(" "), maxPacketSize)...), 0, true, errPacketTooLarge},
+		{"malformed JSON", append([]byte(packetMagic+"\x01"), `{"Type":`...), 0, true, nil},
+		{"missing type", append([]byte(packetMagic+"\x01"), `{"ID":"abc"}`...), 0, true, errMissingType},
+		{"legacy JSON", query, legacyVersion, false, nil},
+		{"legacy JSON with whitespace", append([]byte("\n "), query...), legacyVersion, false, nil},
+		{"versioned", append([]byte(packetMagic+"\x01"), query...), packetVersion, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := parsePacket(test.data)
+			if test.fails {
+				if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+					t.Fatalf("expected error %v, got %v (%+v)", test.err, err, msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if msg.Type != queryType || msg.ID != "abc" || msg.Version != test.version {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+		})
+	}
+}
+
+func TestToPacket(t *testing.T) {
+	announce := newAnnounceMessage("abc", "alice", "192.168.1.5", 45679)
+	tests := []struct {
+		name    string
+		version byte
+		prefix  string
+	}{
+		{"versioned", packetVersion, packetMagic + "\x01"},
+		{"legacy", legacyVersion, "{"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := announce.ToPacket(test.version)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.HasPrefix(data, []byte(test.prefix)) {
+				t.Fatalf("expected prefix %q, got %q", test.prefix, data)
+			}
+			msg, err := parsePacket(data)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if msg.Version != test.version || msg.Peer() != announce.Peer() {
+				t.Fatalf("round-trip mismatch: %+v", msg)
+			}
+		})
+	}
+}
+
+func TestToPacketTooLarge(t *testing.T) {
+	announce := newAnnounceMessage("abc", strings.Repeat("a", maxPacketSize), "192.168.1.5", 45679)
+	for _, version := range []byte{packetVersion, legacyVersion} {
+		if _, err := announce.ToPacket(version); !errors.Is(err, errPacketTooLarge) {
+			t.Fatalf("version %d: expected %v, got %v", version, errPacketTooLarge, err)
+		}
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	announce := newAnnounceMessage("abc", strings.Repeat("a", maxPacketSize), "192.168.1.5", 45679)
+	data, err := announce.Compact().ToPacket(packetVersion)
+	if err != nil {
+		t.Fatalf("compact announce should fit in a packet: %v", err)
+	}
+	msg, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if !msg.Truncated || msg.Name != "" || msg.ID != announce.ID || msg.Peer().Addr != announce.Peer().Addr {
+		t.Fatalf("unexpected compact announce: %+v", msg)
+	}
+}
+
+func TestIsLegacyCopy(t *testing.T) {
+	query := newQueryMessage("abc")
+	data, err := query.ToPacket(legacyVersion)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if !msg.IsLegacyCopy() {
+		t.Fatal("legacy query with nonce should be a legacy copy")
+	}
+	oldQuery, err := parsePacket([]byte(`{"Type":"query","Name":"","Addr":"","TransferPort":0}`))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if oldQuery.IsLegacyCopy() {
+		t.Fatal("query from old client should not be a legacy copy")
+	}
+}
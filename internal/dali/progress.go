@@ -0,0 +1,111 @@
+package dali
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+)
+
+const (
+	progressDir      string = ".dali.progress" // Full path: ~HOME/.dali.progress
+	progressInterval        = 500 * time.Millisecond
+	progressStaleTTL        = 30 * time.Second // Progress not updated for this long is from a dead process
+)
+
+// Progress of in-progress transfer, shared with `logs follow` through a progress file
+type TransferProgress struct {
+	Event       Event
+	Transferred uint64
+	Updated     time.Time
+}
+
+// Writes transfer progress to a progress file, at most once per progressInterval
+type progressTracker struct {
+	path     string
+	progress TransferProgress
+	done     bool
+}
+
+// Folder of progress files of active transfers
+func (l *EventLog) ProgressDir() string {
+	return filepath.Join(filepath.Dir(l.Path), progressDir)
+}
+
+// Start tracking progress of transfer event
+func (l *EventLog) StartProgress(event Event) *progressTracker {
+	name := fmt.Sprintf("%d-%d.json", os.Getpid(), time.Now().UnixNano())
+	tracker := &progressTracker{
+		path:     filepath.Join(l.ProgressDir(), name),
+		progress: TransferProgress{Event: event},
+	}
+	tracker.save()
+	return tracker
+}
+
+// Add number of transferred bytes
+func (t *progressTracker) Add(n int) {
+	t.progress.Transferred += uint64(n)
+	if time.Since(t.progress.Updated) >= progressInterval {
+		t.save()
+	}
+}
+
+// Stop tracking progress when the transfer finishes or fails, removes progress file
+func (t *progressTracker) Done() {
+	t.done = true
+	os.Remove(t.path)
+}
+
+// Write progress file (best effort: progress is only informational, so it is not synced to disk)
+func (t *progressTracker) save() {
+	if t.done {
+		return
+	}
+	t.progress.Updated = clock.Now()
+	data, err := json.Marshal(t.progress)
+	if err != nil {
+		return
+	}
+	replaceFile(t.path, data, false)
+}
+
+// Read progress of active transfers, skipping stale progress files
+func (l *EventLog) ActiveTransfers() []TransferProgress {
+	entries, err := os.ReadDir(l.ProgressDir())
+	if err != nil {
+		return nil
+	}
+	active := make([]TransferProgress, 0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue // skip temp files
+		}
+		data, err := os.ReadFile(filepath.Join(l.ProgressDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		var progress TransferProgress
+		if err = json.Unmarshal(data, &progress); err != nil {
+			continue
+		}
+		if time.Since(progress.Updated) > progressStaleTTL {
+			os.Remove(filepath.Join(l.ProgressDir(), entry.Name())) // left by a process that was killed
+			continue
+		}
+		active = append(active, progress)
+	}
+	return active
+}
+
+// Percent of transferred bytes
+func (p TransferProgress) Percent() float64 {
+	if p.Event.Size == 0 {
+		return 100
+	}
+	return 100 * float64(p.Transferred) / float64(p.Event.Size)
+}
@@ -0,0 +1,39 @@
+package dali
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressFileRemoved(t *testing.T) {
+	events := &EventLog{Path: filepath.Join(t.TempDir(), logsPath)}
+	progress := events.StartProgress(newEvent(actionSend, "/tmp/a.txt", 10, EventPeer{}, EventPeer{}))
+	progress.progress.Updated = time.Time{} // next add saves progress
+	progress.Add(5)
+	if active := events.ActiveTransfers(); len(active) != 1 || active[0].Transferred != 5 {
+		t.Fatalf("expected 1 active transfer with 5 bytes, got %+v", active)
+	}
+	progress.Done()
+	progress.progress.Updated = time.Time{}
+	progress.Add(5)
+	if entries, _ := os.ReadDir(events.ProgressDir()); len(entries) != 0 {
+		t.Fatalf("expected no progress files after transfer is done, got %d", len(entries))
+	}
+
+	// Stale progress file of a killed process is removed
+	stale := TransferProgress{Event: newEvent(actionSend, "/tmp/b.txt", 10, EventPeer{}, EventPeer{}), Updated: time.Now().Add(-2 * progressStaleTTL)}
+	data, _ := json.Marshal(stale)
+	stalePath := filepath.Join(events.ProgressDir(), "1-1.json")
+	if err := os.WriteFile(stalePath, data, 0o600); err != nil {
+		t.Fatalf("failed to write progress file: %v", err)
+	}
+	if active := events.ActiveTransfers(); len(active) != 0 {
+		t.Fatalf("expected no active transfers, got %+v", active)
+	}
+	if _, err := os.Stat(stalePath); err == nil {
+		t.Fatal("expected stale progress file to be removed")
+	}
+}
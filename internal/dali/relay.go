@@ -0,0 +1,295 @@
+package dali
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roidaradal/fn/str"
+)
+
+// Max number of relays a query can pass through
+const maxRelayHops int = 1
+
+// Proxy listener is closed after being idle (no open connections) for this long
+const proxyIdleTimeout = 10 * time.Minute
+
+// Network interface bridged by the relay
+type relayInterface struct {
+	Name      string
+	IP        net.IP
+	Subnet    *net.IPNet
+	Broadcast net.IP
+}
+
+// Relay bridges discovery between network interfaces, and optionally proxies transfers
+type relay struct {
+	conn       *net.UDPConn
+	port       int
+	interfaces []relayInterface
+	window     time.Duration
+	guard      *discoveryGuard
+	proxy      bool
+	mu         sync.Mutex
+	proxies    map[string]string // interface IP + target address => proxy address
+}
+
+// Get IPv4 network interfaces that can be bridged (up, non-loopback, with broadcast)
+func getRelayInterfaces() ([]relayInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, wrapErr("failed to get network interfaces", err)
+	}
+	relayIfaces := make([]relayInterface, 0)
+	subnets := make(map[string]bool)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue // skip if cannot get address
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet) // type-cast into IPNet
+			if !ok {
+				continue
+			}
+			ipv4 := ipnet.IP.To4()
+			if ipv4 == nil {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipv4.Mask(ipnet.Mask), Mask: ipnet.Mask}
+			if subnets[subnet.String()] {
+				continue // skip other addresses in same subnet
+			}
+			subnets[subnet.String()] = true
+			// Compute subnet broadcast address: IP | ~mask
+			broadcast := make(net.IP, 4)
+			mask := binary.BigEndian.Uint32(net.IP(ipnet.Mask).To4())
+			binary.BigEndian.PutUint32(broadcast, binary.BigEndian.Uint32(ipv4)|^mask)
+			relayIfaces = append(relayIfaces, relayInterface{
+				Name:      iface.Name,
+				IP:        ipv4,
+				Subnet:    subnet,
+				Broadcast: broadcast,
+			})
+		}
+	}
+	return relayIfaces, nil
+}
+
+// Run relay: forward discovery queries to other interfaces, and announces back to querier
+func runRelay(r *relay) error {
+	go r.guard.ReportStats()
+	buf := make([]byte, readBufSize)
+	for {
+		n, srcAddr, err := r.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+
+		if ok, reason := r.guard.Check(srcAddr.IP); !ok {
+			r.guard.Drop(srcAddr, reason)
+			continue
+		}
+
+		msg, err := parsePacket(buf[:n])
+		if err != nil {
+			r.guard.Drop(srcAddr, dropInvalid)
+			continue
+		}
+		if msg.Type != queryType {
+			r.guard.Drop(srcAddr, dropNotQuery)
+			continue
+		}
+		if msg.Hops >= maxRelayHops {
+			r.guard.Drop(srcAddr, dropRelayed)
+			continue // already relayed: prevent loops
+		}
+
+		srcIface, ok := r.interfaceOf(srcAddr.IP)
+		if !ok {
+			r.guard.Drop(srcAddr, dropNotAllow)
+			continue // not from a bridged subnet
+		}
+
+		r.guard.Answer(srcAddr)
+		for _, iface := range r.interfaces {
+			if iface.Subnet.Contains(srcAddr.IP) {
+				continue // skip source interface
+			}
+			go r.forwardQuery(*msg, srcAddr, srcIface, iface)
+		}
+	}
+}
+
+// Find bridged interface whose subnet contains the IP address
+func (r *relay) interfaceOf(ip net.IP) (relayInterface, bool) {
+	for _, iface := range r.interfaces {
+		if iface.Subnet.Contains(ip) {
+			return iface, true
+		}
+	}
+	return relayInterface{}, false
+}
+
+// Broadcast query on target interface, and forward announces back to querier
+func (r *relay) forwardQuery(query DiscoveryMessage, srcAddr *net.UDPAddr, srcIface, iface relayInterface) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: iface.IP, Port: 0})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	version := query.Version
+	query.Hops += 1
+	data, err := query.ToPacket(version)
+	if err != nil {
+		return
+	}
+	_, err = conn.WriteToUDP(data, &net.UDPAddr{IP: iface.Broadcast, Port: r.port})
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, readBufSize)
+	conn.SetReadDeadline(time.Now().Add(r.window))
+	for {
+		n, peerAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // deadline reached
+		}
+		announce, err := parsePacket(buf[:n])
+		if err != nil || announce.Type != announceType {
+			continue
+		}
+		announce.Hops = query.Hops
+		if r.proxy {
+			// Only proxy to the announcing peer's own transfer port, if its announce is signed
+			target, ok := proxyTarget(announce, peerAddr, &query)
+			if !ok {
+				continue
+			}
+			proxyAddr, err := r.proxyFor(srcIface, target)
+			if err != nil {
+				continue
+			}
+			announce.Via = proxyAddr
+		}
+		data, err := announce.ToPacket(version)
+		if err != nil {
+			continue
+		}
+		r.conn.WriteToUDP(data, srcAddr)
+	}
+}
+
+// Get proxy target of announce: transfer port of the peer that sent the announce.
+// The announce must be signed and its address must match the sender's address, so the relay
+// cannot be used to proxy to arbitrary hosts. Full announce is fetched for compact announces
+func proxyTarget(announce *DiscoveryMessage, peerAddr *net.UDPAddr, query *DiscoveryMessage) (string, bool) {
+	if announce.Addr != peerAddr.IP.String() {
+		return "", false
+	}
+	target := net.JoinHostPort(peerAddr.IP.String(), str.Int(int(announce.TransferPort)))
+	if announce.Truncated {
+		pong, err := pingPeer(target, query, pingTimeout)
+		if err != nil {
+			return "", false
+		}
+		full := pong.Announce
+		if full.ID != announce.ID || full.Addr != announce.Addr || full.TransferPort != announce.TransferPort {
+			return "", false
+		}
+		announce = full
+	}
+	return target, announce.Verify()
+}
+
+// Get proxy address on source interface for target transfer address, starts proxy if needed
+func (r *relay) proxyFor(srcIface relayInterface, target string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := srcIface.IP.String() + "|" + target
+	if proxyAddr, ok := r.proxies[key]; ok {
+		return proxyAddr, nil
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: srcIface.IP, Port: 0})
+	if err != nil {
+		return "", wrapErr("failed to start proxy", err)
+	}
+	proxyAddr := listener.Addr().String()
+	r.proxies[key] = proxyAddr
+	fmt.Printf("Proxy %s => %s\n", proxyAddr, target)
+	go r.runProxy(key, listener, target)
+	return proxyAddr, nil
+}
+
+// Accept connections on proxy listener, and pipe them to target address.
+// Proxy is closed once it has no open connections for proxyIdleTimeout
+func (r *relay) runProxy(key string, listener *net.TCPListener, target string) {
+	var active atomic.Int32
+	defer func() {
+		r.mu.Lock()
+		delete(r.proxies, key)
+		r.mu.Unlock()
+		listener.Close()
+		fmt.Printf("Proxy %s => %s closed (idle)\n", listener.Addr(), target)
+	}()
+	for {
+		listener.SetDeadline(time.Now().Add(proxyIdleTimeout))
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if active.Load() == 0 {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		active.Add(1)
+		go func(c net.Conn) {
+			defer active.Add(-1)
+			defer c.Close()
+			targetConn, err := net.DialTimeout("tcp", target, pingTimeout)
+			if err != nil {
+				fmt.Printf("Proxy error: %v\n", err)
+				return
+			}
+			defer targetConn.Close()
+			pipe(c, targetConn)
+		}(conn)
+	}
+}
+
+// Copy data in both directions until either side closes
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyData := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Signal end of stream to the other side
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyData(a, b)
+	go copyData(b, a)
+	<-done
+	<-done
+}
@@ -0,0 +1,156 @@
+package dali
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/list"
+	"github.com/roidaradal/fn/str"
+)
+
+// Find logged send event by ID or ID prefix
+func findSendEvent(events []Event, id string) (Event, error) {
+	matched := list.Filter(events, func(e Event) bool {
+		return strings.HasPrefix(e.ID, id)
+	})
+	switch {
+	case len(matched) == 0:
+		return Event{}, fmt.Errorf("log #%s not found. Use `dali %s` to view log IDs", id, logsCmd)
+	case len(matched) > 1:
+		return Event{}, fmt.Errorf("log #%s matches %d logs, use a longer ID", id, len(matched))
+	}
+	event := matched[0]
+	if event.Action != actionSend {
+		return Event{}, fmt.Errorf("log #%s is a %s log, only send logs can be resent", event.ID, event.Action)
+	}
+	if event.Stream {
+		return Event{}, fmt.Errorf("log #%s was sent from stdin, and cannot be resent", event.ID)
+	}
+	return event, nil
+}
+
+// Describe changes of logged file since the transfer (size, modification time, checksum)
+func fileChanges(event Event) ([]string, error) {
+	info, err := os.Stat(event.Path)
+	if err != nil {
+		return nil, wrapErr(fmt.Sprintf("cannot resend %q", event.Path), err)
+	}
+	changes := make([]string, 0)
+	size := uint64(info.Size())
+	if info.IsDir() {
+		size = event.Size // folder contents are not compared, only its modification time
+	}
+	if size != event.Size {
+		changes = append(changes, fmt.Sprintf("size changed from %s to %s", computeFileSize(event.Size), computeFileSize(size)))
+	}
+	if !event.ModTime.IsZero() && !info.ModTime().Equal(event.ModTime) {
+		changes = append(changes, fmt.Sprintf("modified at %s", clock.StandardFormat(info.ModTime())))
+	}
+	if event.Checksum != "" && size == event.Size && !info.IsDir() {
+		checksum, err := fileChecksum(event.Path)
+		if err != nil {
+			return nil, err
+		}
+		if checksum != event.Checksum {
+			changes = append(changes, "content changed (checksum mismatch)")
+		}
+	}
+	return changes, nil
+}
+
+// Sender settings of logged send event: folders are sent with the same options as before
+func resendOptions(event Event, token string) sendOptions {
+	opts := defaultSendOptions()
+	if event.Links != "" {
+		opts.Links = event.Links
+	}
+	opts.EmptyDirs, opts.Token = event.EmptyDirs, token
+	return opts
+}
+
+// Compute SHA-256 checksum of file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", wrapErr("failed to open file", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", wrapErr("failed to read file", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Find logged receiver: ping its last known addresses (logged and contact address),
+// then find it by ID or name if its address has changed
+func findReceiver(node *Node, receiver EventPeer, params Discovery) (Peer, error) {
+	contacts := node.KnownContacts()
+	addrs := []string{receiver.Addr}
+	if contact, ok := contacts[receiver.ID]; ok && contact.Addr != "" && !slices.Contains(addrs, contact.Addr) {
+		addrs = append(addrs, contact.Addr)
+	}
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		pong, err := pingPeer(addr, params.Query, pingTimeout)
+		if err != nil || !atAddress(pong, receiver, params.Query, addr) {
+			continue // unreachable, or another node is now at this address
+		}
+		peer := verifiedPeer(pong.Announce, contacts)
+		peer.Addr = addr
+		return peer, nil
+	}
+
+	// Find receiver by ID, or by name if ID is unknown (older logs)
+	target := receiver.ID
+	params.Filter = Peer{ID: receiver.ID, Name: anything, Addr: anything}
+	if receiver.ID == "" {
+		target = receiver.Name
+		params.Filter = Peer{ID: anything, Name: receiver.Name, Addr: anything}
+	}
+	fmt.Printf("%s is not at its last known address, finding %s...\n", receiver.Name, target)
+	fmt.Println(findingMessage(node))
+	peers, err := discoverPeers(node.Addr, params)
+	if err != nil {
+		return Peer{}, wrapErr("discovery failed", err)
+	}
+	switch len(peers) {
+	case 0:
+		return Peer{}, fmt.Errorf("receiver %s (%s) not found. Make sure it is running `dali %s`", receiver.Name, target, openCmd)
+	case 1:
+		return peers[0], nil
+	}
+	return Peer{}, fmt.Errorf("found %d peers named %s, use `dali %s` to choose the receiver", len(peers), receiver.Name, sendCmd)
+}
+
+// Check if pong is from the receiver at the address: the receiver's signed announce must be
+// for this address and transfer port, and the pong must answer our query
+func atAddress(pong *TransferMessage, receiver EventPeer, query *DiscoveryMessage, addr string) bool {
+	announce := pong.Announce
+	if receiver.ID == "" || announce.ID != receiver.ID || announce.Via != "" || !pong.AnswersQuery(query) {
+		return false
+	}
+	return net.JoinHostPort(announce.Addr, str.Int(int(announce.TransferPort))) == addr && announce.Verify()
+}
+
+// Default discovery params for finding a peer
+func findParams(node *Node, port int, token string) Discovery {
+	return Discovery{
+		Timeout:     time.Duration(node.Timeout) * time.Second,
+		EndASAP:     true,
+		Port:        port,
+		Query:       nodeQuery(node, token),
+		Contacts:    node.KnownContacts(),
+		StaticPeers: node.Peers,
+	}
+}
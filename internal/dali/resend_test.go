@@ -0,0 +1,79 @@
+package dali
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSendEventAfterPrune(t *testing.T) {
+	events := make([]Event, 0)
+	for i := range 5 {
+		events = append(events, newEvent(actionSend, fmt.Sprintf("/tmp/file%d.txt", i), uint64(i), EventPeer{}, EventPeer{}))
+	}
+	target := events[3]
+	// Oldest logs are pruned: IDs of remaining logs do not change
+	for _, logs := range [][]Event{events, events[2:]} {
+		event, err := findSendEvent(logs, target.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if event.Path != target.Path {
+			t.Fatalf("expected %s, got %s", target.Path, event.Path)
+		}
+	}
+	if _, err := findSendEvent(events[:3], target.ID); err == nil {
+		t.Fatal("expected error for pruned log")
+	}
+	if _, err := findSendEvent(events, ""); err == nil {
+		t.Fatal("expected error for ambiguous ID prefix")
+	}
+}
+
+func TestDerivedEventID(t *testing.T) {
+	// Logs saved before IDs were added get the same ID every time they are read
+	line := []byte(`{"Schema":1,"Time":"2026-01-20T16:41:00Z","Action":"send","Result":"ok","Path":"/tmp/a.txt","Sender":{"Name":"alice"},"Receiver":{"Name":"bob"}}`)
+	var first, second Event
+	if err := json.Unmarshal(line, &first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(line, &second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.ID == "" || first.ID != second.ID {
+		t.Fatalf("expected stable derived ID, got %q and %q", first.ID, second.ID)
+	}
+}
+
+func TestResendFolderOptions(t *testing.T) {
+	receiver, sender := newTestNode(t), newTestNode(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go receiveFiles(receiver, listener, receiveOptions{OutputDir: t.TempDir(), AutoAccept: true})
+
+	folder := filepath.Join(t.TempDir(), "photos")
+	if err = os.MkdirAll(filepath.Join(folder, "empty"), 0o755); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	opts := sendOptions{Links: linksSkip, EmptyDirs: true}
+	if err = sendFile(sender, Peer{Addr: listener.Addr().String()}, folder, opts); err != nil {
+		t.Fatalf("failed to send folder: %v", err)
+	}
+	events, err := sender.Events.ReadAll()
+	if err != nil || len(events) != 1 {
+		t.Fatalf("failed to read logs: %v", err)
+	}
+	if got := resendOptions(events[0], "secret"); got != (sendOptions{Links: linksSkip, EmptyDirs: true, Token: "secret"}) {
+		t.Fatalf("expected folder options to be restored, got %+v", got)
+	}
+	// Logs saved before folder options were logged use the defaults
+	if got := resendOptions(Event{Path: folder}, ""); got != defaultSendOptions() {
+		t.Fatalf("expected default options, got %+v", got)
+	}
+}
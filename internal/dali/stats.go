@@ -0,0 +1,239 @@
+package dali
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/dict"
+	"github.com/roidaradal/fn/lang"
+	"github.com/roidaradal/fn/list"
+	"github.com/roidaradal/fn/str"
+)
+
+const (
+	maxStatsDays   int     = 5    // Number of busiest days shown
+	maxStatsFiles  int     = 5    // Number of largest files shown
+	flakyPeerRate  float64 = 80.0 // Peers with success rate below this are highlighted
+	statsDivider   string  = "-------------------------"
+	statsNoPeerKey string  = "(unknown)"
+)
+
+// Transfer statistics computed from event logs
+type TransferStats struct {
+	Transfers     int
+	Results       dict.Counter[EventResult]
+	SuccessRate   float64 // percent of ok transfers, excluding rejected
+	BytesSent     uint64
+	BytesReceived uint64
+	AvgThroughput float64 // bytes per second of ok transfers
+	Peers         []*PeerStats
+	BusiestDays   []DayStats
+	LargestFiles  []FileStats
+	duration      time.Duration
+	timedBytes    uint64
+}
+
+// Transfer statistics with one peer
+type PeerStats struct {
+	Name          string
+	ID            string `json:",omitempty"`
+	Transfers     int
+	Results       dict.Counter[EventResult]
+	SuccessRate   float64
+	BytesSent     uint64
+	BytesReceived uint64
+	AvgThroughput float64
+	duration      time.Duration
+	timedBytes    uint64
+}
+
+// Transfer statistics of one day
+type DayStats struct {
+	Date      string
+	Transfers int
+	Bytes     uint64
+}
+
+// Transferred file
+type FileStats struct {
+	Time   time.Time
+	Action EventAction
+	Peer   string
+	Path   string
+	Size   uint64
+}
+
+// Compute transfer statistics from events
+func computeStats(events []Event) *TransferStats {
+	stats := &TransferStats{Results: make(dict.Counter[EventResult])}
+	peers := make(map[string]*PeerStats)
+	days := make(map[string]*DayStats)
+	for _, e := range events {
+		// Peer is the other side of the transfer
+		peer := lang.Ternary(e.Action == actionSend, e.Receiver, e.Sender)
+		key := cmp.Or(peer.ID, strings.ToLower(peer.Name), statsNoPeerKey)
+		p, ok := peers[key]
+		if !ok {
+			p = &PeerStats{Name: cmp.Or(peer.Name, statsNoPeerKey), ID: peer.ID, Results: make(dict.Counter[EventResult])}
+			peers[key] = p
+		}
+		p.Name = cmp.Or(peer.Name, p.Name) // use latest name
+
+		stats.Transfers += 1
+		stats.Results[e.Result] += 1
+		p.Transfers += 1
+		p.Results[e.Result] += 1
+		if e.Result != resultOK {
+			continue
+		}
+
+		if e.Action == actionSend {
+			stats.BytesSent += e.Size
+			p.BytesSent += e.Size
+		} else {
+			stats.BytesReceived += e.Size
+			p.BytesReceived += e.Size
+		}
+		if e.Duration > 0 {
+			stats.duration += e.Duration
+			stats.timedBytes += e.Size
+			p.duration += e.Duration
+			p.timedBytes += e.Size
+		}
+
+		date := clock.DateFormat(e.Time)
+		if _, ok := days[date]; !ok {
+			days[date] = &DayStats{Date: date}
+		}
+		days[date].Transfers += 1
+		days[date].Bytes += e.Size
+
+		if e.Kind == kindMessage {
+			continue
+		}
+		stats.LargestFiles = append(stats.LargestFiles, FileStats{
+			Time:   e.Time,
+			Action: e.Action,
+			Peer:   p.Name,
+			Path:   e.Path,
+			Size:   e.Size,
+		})
+	}
+
+	stats.SuccessRate = successRate(stats.Results)
+	stats.AvgThroughput = throughput(stats.timedBytes, stats.duration)
+	for _, p := range peers {
+		p.SuccessRate = successRate(p.Results)
+		p.AvgThroughput = throughput(p.timedBytes, p.duration)
+		stats.Peers = append(stats.Peers, p)
+	}
+	slices.SortFunc(stats.Peers, func(p1, p2 *PeerStats) int {
+		return cmp.Or(cmp.Compare(p2.Transfers, p1.Transfers), cmp.Compare(p1.Name, p2.Name))
+	})
+
+	for _, day := range days {
+		stats.BusiestDays = append(stats.BusiestDays, *day)
+	}
+	slices.SortFunc(stats.BusiestDays, func(d1, d2 DayStats) int {
+		return cmp.Or(cmp.Compare(d2.Transfers, d1.Transfers), cmp.Compare(d2.Bytes, d1.Bytes), cmp.Compare(d2.Date, d1.Date))
+	})
+	stats.BusiestDays = stats.BusiestDays[:min(maxStatsDays, len(stats.BusiestDays))]
+
+	slices.SortStableFunc(stats.LargestFiles, func(f1, f2 FileStats) int {
+		return cmp.Compare(f2.Size, f1.Size)
+	})
+	stats.LargestFiles = stats.LargestFiles[:min(maxStatsFiles, len(stats.LargestFiles))]
+	return stats
+}
+
+// Percent of ok transfers, excluding rejected transfers
+func successRate(results dict.Counter[EventResult]) float64 {
+	attempts := results[resultOK] + results[resultFail] + results[resultInvalid]
+	if attempts == 0 {
+		return 0
+	}
+	return 100 * float64(results[resultOK]) / float64(attempts)
+}
+
+// Compute bytes per second
+func throughput(numBytes uint64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(numBytes) / duration.Seconds()
+}
+
+// Display transfer statistics as terminal tables
+func displayStats(stats *TransferStats) {
+	fmt.Printf("Transfers: %d (%s), success rate: %s\n", stats.Transfers, resultCounts(stats.Results), formatRate(stats.SuccessRate))
+	fmt.Printf("Sent: %s, Received: %s, Avg throughput: %s\n", computeFileSize(stats.BytesSent), computeFileSize(stats.BytesReceived), formatThroughput(stats.AvgThroughput))
+	if stats.Transfers == 0 {
+		return
+	}
+
+	fmt.Println(statsDivider)
+	fmt.Println("Peers:")
+	nameLength := slices.Max(list.Map(stats.Peers, func(p *PeerStats) int {
+		return len(p.Name)
+	}))
+	nameLength = max(nameLength, len("NAME"))
+	// Success rate column is pre-padded, so it can be colored
+	template := fmt.Sprintf("  %%-%ds %%-16s %%9s %%9s %%5s %%5s %%6s %%s %%11s\n", nameLength)
+	fmt.Printf(template, "NAME", "ID", "SENT", "RECEIVED", "OK", "FAIL", "REJECT", fmt.Sprintf("%8s", "SUCCESS"), "THROUGHPUT")
+	for _, p := range stats.Peers {
+		rate := fmt.Sprintf("%8s", formatRate(p.SuccessRate))
+		if p.SuccessRate < flakyPeerRate && p.Results[resultOK]+p.Results[resultFail]+p.Results[resultInvalid] > 0 {
+			rate = str.Red(rate) // flaky peer or link
+		}
+		fmt.Printf(template,
+			p.Name, cmp.Or(p.ID, "-"),
+			computeFileSize(p.BytesSent), computeFileSize(p.BytesReceived),
+			str.Int(p.Results[resultOK]), str.Int(p.Results[resultFail]+p.Results[resultInvalid]), str.Int(p.Results[resultReject]),
+			rate, formatThroughput(p.AvgThroughput),
+		)
+	}
+
+	if len(stats.BusiestDays) > 0 {
+		fmt.Println(statsDivider)
+		fmt.Println("Busiest days:")
+		for _, day := range stats.BusiestDays {
+			fmt.Printf("  %s %4d transfers %9s\n", day.Date, day.Transfers, computeFileSize(day.Bytes))
+		}
+	}
+
+	if len(stats.LargestFiles) > 0 {
+		fmt.Println(statsDivider)
+		fmt.Println("Largest files:")
+		for _, file := range stats.LargestFiles {
+			direction := lang.Ternary(file.Action == actionSend, "to", "from")
+			fmt.Printf("  %9s %s %-4s %s: %s\n", computeFileSize(file.Size), clock.DateFormat(file.Time), direction, file.Peer, file.Path)
+		}
+	}
+}
+
+// Summary of result counts, e.g. ok=3, fail=1
+func resultCounts(results dict.Counter[EventResult]) string {
+	counts := make([]string, 0, len(results))
+	for _, entry := range dict.SortedEntries(results) {
+		result, count := entry.Tuple()
+		counts = append(counts, fmt.Sprintf("%s=%d", result, count))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// Format percent rate
+func formatRate(rate float64) string {
+	return fmt.Sprintf("%.1f%%", rate)
+}
+
+// Format throughput in bytes per second
+func formatThroughput(bytesPerSec float64) string {
+	if bytesPerSec <= 0 {
+		return "-"
+	}
+	return computeFileSize(uint64(bytesPerSec)) + "/s"
+}
@@ -0,0 +1,138 @@
+package dali
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Event path prefixes for piped transfers
+const (
+	stdinPrefix  string = "stdin:"  // sent from stdin (send stdin)
+	stdoutPrefix string = "stdout:" // received to stdout (open stdout)
+)
+
+// Stream data of unknown size is sent in frames: 4-byte length (big-endian), then data.
+// A zero-length frame marks the end of stream
+const frameHeaderSize int = 4
+
+// Time to discard stream data after aborting a stream, so the sender can read the final status before the connection is closed
+const streamDrainTimeout = 10 * time.Second
+
+// Writes data as frames
+type frameWriter struct {
+	w io.Writer
+}
+
+// Create new frameWriter
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: w}
+}
+
+// Write data as one frame
+func (f *frameWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil // zero-length frame would end the stream
+	}
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+	if _, err := f.w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Write end of stream frame
+func (f *frameWriter) Close() error {
+	_, err := f.w.Write(make([]byte, frameHeaderSize))
+	return err
+}
+
+// Reads data from frames, until end of stream
+type frameReader struct {
+	r         *bufio.Reader
+	remaining int
+	done      bool
+}
+
+// Create new frameReader
+func newFrameReader(r *bufio.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+// Read frame data. Returns io.EOF at end of stream, and io.ErrUnexpectedEOF
+// if the connection is closed before end of stream
+func (f *frameReader) Read(buf []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+	if f.remaining == 0 {
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(f.r, header); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+		if size > uint32(chunkSize) {
+			return 0, fmt.Errorf("invalid frame size %d", size)
+		}
+		f.remaining = int(size)
+	}
+	n, err := f.r.Read(buf[:min(len(buf), f.remaining)])
+	f.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Writer with no-op Close, for writing received data to stdout
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Send final status of stream to sender: accept if stream was saved, or reject with reason.
+// Sent after the end of stream frame, or when the receiver aborts the stream
+func endStream(conn net.Conn, self Identity, reason, note string) {
+	msg := newAcceptMessage(self.ID, self.Name)
+	if reason != "" {
+		msg = newRejectMessage(self.ID, self.Name)
+		msg.Reason, msg.Note = reason, note
+	}
+	self.Sign(msg)
+	conn.Write(msg.ToBytes())
+}
+
+// Abort stream: send reject status, then discard stream data until the sender stops sending
+func abortStream(conn net.Conn, reader *bufio.Reader, self Identity, reason, note string) {
+	endStream(conn, self, reason, note)
+	conn.SetReadDeadline(time.Now().Add(streamDrainTimeout))
+	io.Copy(io.Discard, reader)
+}
+
+// Read final status of stream from receiver into channel, nil if the connection was closed without status
+func readStreamStatus(reader *bufio.Reader, status chan<- *TransferMessage) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		status <- nil
+		return
+	}
+	msg, err := parseMessage[TransferMessage]([]byte(strings.TrimSpace(line)))
+	if err != nil {
+		msg = nil
+	}
+	status <- msg
+}
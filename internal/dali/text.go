@@ -0,0 +1,186 @@
+package dali
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/lang"
+)
+
+// Max size of text message (64KB)
+const maxTextSize int = 64 * 1024
+
+// Option keys of msg command (send options that apply to messages), other arguments are the message text.
+// Flags are given with a value (e.g. wait=1), as bare words are part of the message
+var msgOptionKeys = []string{"for", "to", "auto", "discovery", "token", "wait", "net"}
+
+// Get message text and options from msg command arguments: key=value arguments
+// with msg option keys are options, the rest are words of the message
+func parseMsgArgs(args []string) (string, map[string]string) {
+	words := make([]string, 0, len(args))
+	options := make(map[string]string)
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		key = strings.ToLower(key)
+		switch {
+		case ok && key == "text":
+			words = append(words, value)
+		case ok && slices.Contains(msgOptionKeys, key):
+			options[key] = value
+		default:
+			words = append(words, arg)
+		}
+	}
+	return strings.Join(words, " "), options
+}
+
+// Send text message to specified address, with token proof for hidden receivers
+func sendText(node *Node, peer Peer, text, token string) error {
+	if len(text) > maxTextSize {
+		return fmt.Errorf("message is too long (%d bytes), max is %d bytes", len(text), maxTextSize)
+	}
+
+	fmt.Printf("Connecting to %s...\n", peer.Addr)
+	conn, err := net.Dial("tcp", peer.Addr)
+	if err != nil {
+		return wrapErr("failed to connect", err)
+	}
+	defer conn.Close()
+
+	self := node.Identity()
+	msg := newTextMessage(self.ID, self.Name, text)
+	msg.Query = nodeQuery(node, token)
+	self.Sign(msg)
+	if _, err = conn.Write(msg.ToBytes()); err != nil {
+		return wrapErr("failed to send message", err)
+	}
+
+	responseLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return wrapErr("failed to read response", err)
+	}
+	response, err := parseMessage[TransferMessage]([]byte(strings.TrimSpace(responseLine)))
+	if err != nil {
+		return wrapErr("invalid response", err)
+	}
+
+	peer, verified := responsePeer(node, peer, response)
+	sender := EventPeer{Name: self.Name, ID: self.ID, Addr: conn.LocalAddr().String()}
+	receiver := EventPeer{Name: peer.Name, ID: peer.ID, Addr: conn.RemoteAddr().String()}
+	event := newEvent(actionSend, "", uint64(len(text)), sender, receiver)
+	event.Kind, event.Text = kindMessage, text
+	event.Reason, event.Note = response.Reason, response.Note
+
+	switch response.Type {
+	case acceptType:
+		if verified {
+			saveContact(node, peer.ID, peer.Name, peer.Addr, peer.PubKey)
+		}
+		addLog(node, event, resultOK, nil)
+		fmt.Println("✓ Message delivered!")
+		return nil
+	case rejectType:
+		err = response.ReasonError()
+		addLog(node, event, resultReject, err)
+		if err != nil {
+			fmt.Println("Peer rejected the message:", err)
+		} else {
+			fmt.Println("Peer rejected the message.")
+		}
+		return nil
+	default:
+		err = fmt.Errorf("invalid response from peer: %s", response.Type)
+		addLog(node, event, resultInvalid, err)
+		return err
+	}
+}
+
+// Handle incoming text message: display it, and append it to inbox file if set
+func receiveText(node *Node, conn net.Conn, msg *TransferMessage, opts receiveOptions) error {
+	self := node.Identity()
+	sender := EventPeer{Name: msg.Sender, ID: msg.SenderID, Addr: conn.RemoteAddr().String()}
+	receiver := EventPeer{Name: self.Name, ID: self.ID, Addr: conn.LocalAddr().String()}
+	event := newEvent(actionReceive, "", uint64(len(msg.Text)), sender, receiver)
+	event.Kind, event.Text = kindMessage, msg.Text
+
+	reason, err := checkOfferSender(node, msg, opts)
+	if reason == "" && len(msg.Text) > maxTextSize {
+		reason, err = reasonTooLarge, fmt.Errorf("message is too long (%d bytes)", len(msg.Text))
+		event.Text = ""
+	}
+	if reason != "" {
+		response := newRejectMessage(self.ID, self.Name)
+		response.Reason = reason
+		self.Sign(response)
+		conn.Write(response.ToBytes())
+		event.Reason = reason
+		addLog(node, event, resultReject, err)
+		return wrapErr(fmt.Sprintf("rejected message from %s", senderLabel(node, msg)), err)
+	}
+	response := newAcceptMessage(self.ID, self.Name)
+	response.Reason = reasonAuto
+	self.Sign(response)
+	event.Reason = reasonAuto
+	if _, err := conn.Write(response.ToBytes()); err != nil {
+		return wrapErr("failed to send response", err)
+	}
+	if msg.Verify() {
+		// Unverified senders could claim any name, so only verified senders are saved
+		saveContact(node, msg.SenderID, msg.Sender, "", msg.PubKey)
+	}
+
+	text := sanitizeText(msg.Text)
+	fmt.Printf("\n%s %s:\n%s\n", clock.StandardFormat(event.Time), senderLabel(node, msg), text)
+
+	if opts.Inbox != "" {
+		inboxPath, err := filepath.Abs(opts.Inbox)
+		if err == nil {
+			err = appendInbox(inboxPath, fmt.Sprintf("[%s] %s: %s\n", clock.StandardFormat(event.Time), msg.Sender, text))
+		}
+		if err != nil {
+			addLog(node, event, resultFail, err)
+			return wrapErr("failed to save message to inbox", err)
+		}
+		event.Path = inboxPath
+	}
+	addLog(node, event, resultOK, nil)
+	return nil
+}
+
+// Append line to inbox file
+func appendInbox(path, line string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(line)
+	return err
+}
+
+// Remove control characters (except newline and tab) from text, so it is safe to print
+func sanitizeText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Shorten text to first line, with at most maxLength characters
+func shortenText(text string, maxLength int) string {
+	line, _, multiline := strings.Cut(sanitizeText(text), "\n")
+	runes := []rune(line)
+	if len(runes) > maxLength {
+		return string(runes[:maxLength-1]) + "…"
+	}
+	return lang.Ternary(multiline, line+"…", line)
+}
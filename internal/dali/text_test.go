@@ -0,0 +1,17 @@
+package dali
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseMsgArgs(t *testing.T) {
+	text, options := parseMsgArgs([]string{"for=bob", "please", "wait", "net=10.0.0.5", "wait=1", "a=b", "TOKEN=x"})
+	if text != "please wait a=b" {
+		t.Fatalf("unexpected text %q", text)
+	}
+	want := map[string]string{"for": "bob", "net": "10.0.0.5", "wait": "1", "token": "x"}
+	if !maps.Equal(options, want) {
+		t.Fatalf("expected options %v, got %v", want, options)
+	}
+}
@@ -2,36 +2,89 @@ package dali
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/roidaradal/fn/clock"
+	"github.com/roidaradal/fn/lang"
+	"github.com/roidaradal/fn/list"
+	"github.com/roidaradal/fn/str"
 )
 
 // Chunk size for file transfer (64KB)
 const chunkSize int = 64 * 1024
 
-// Send file to specified address
-func sendFile(node *Node, peer Peer, filePath string) error {
-	// Open file and get info
-	file, err := os.Open(filePath)
-	if err != nil {
-		return wrapErr("failed to open file", err)
-	}
-	defer file.Close()
+// Sender settings for outgoing transfers
+type sendOptions struct {
+	Links     string // symlink policy: follow, keep, skip
+	EmptyDirs bool   // include empty folders
+	Stdin     bool   // send data piped from stdin
+	Name      string // file name of data from stdin
+	Token     string // shared token, proves the offer to hidden receivers
+}
 
-	info, err := file.Stat()
-	if err != nil {
-		return wrapErr("failed to get file info", err)
-	}
+// Default sender settings
+func defaultSendOptions() sendOptions {
+	return sendOptions{Links: linksKeep}
+}
 
-	fileSize := uint64(info.Size())
-	fileName := filepath.Base(filePath)
-	size := fmt.Sprintf("%d", fileSize)
+// Send file (or folder, or data piped from stdin) to specified address
+func sendFile(node *Node, peer Peer, filePath string, opts sendOptions) error {
+	self := node.Identity()
+	var offer *TransferMessage
+	var source io.Reader // file data: file contents, folder files in entry order, or stdin
+	var modTime time.Time
+	if opts.Stdin {
+		// Size is unknown: data is sent in frames until end of stream
+		offer = newOfferMessage(self.ID, self.Name, opts.Name, 0)
+		offer.Stream = true
+		source = inputReader // shared with prompts, so no buffered input is lost
+		filePath = stdinPrefix + opts.Name
+	} else {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return wrapErr("failed to get file info", err)
+		}
+		offer = newOfferMessage(self.ID, self.Name, filepath.Base(filePath), uint64(info.Size()))
+		offer.Mode, offer.ModTime = uint32(info.Mode().Perm()), info.ModTime().UnixNano()
+		modTime = info.ModTime()
+		if info.IsDir() {
+			entries, warnings, err := walkTree(filePath, opts)
+			if err != nil {
+				return err
+			}
+			for _, warning := range warnings {
+				fmt.Println("Warning:", warning)
+			}
+			offer.Type, offer.Entries, offer.Size = treeOfferType, entries, 0
+			for _, entry := range entries {
+				offer.Size += entry.Size
+			}
+			reader := newTreeReader(filePath, entries)
+			defer reader.Close()
+			source = reader
+		} else {
+			file, err := os.Open(filePath)
+			if err != nil {
+				return wrapErr("failed to open file", err)
+			}
+			defer file.Close()
+			source = file
+		}
+		if filePath, err = filepath.Abs(filePath); err != nil {
+			return wrapErr("failed to get absolute file path", err)
+		}
+	}
+	fileName, fileSize := offer.Filename, offer.Size
 
 	// Connect to peer via TCP
 	fmt.Printf("Connecting to %s...\n", peer.Addr)
@@ -41,8 +94,9 @@ func sendFile(node *Node, peer Peer, filePath string) error {
 	}
 	defer conn.Close()
 
-	// Send file offer
-	offer := newOfferMessage(node.Name, fileName, fileSize)
+	// Send file offer, with signed query (hidden receivers only answer paired contacts or token)
+	offer.Query = nodeQuery(node, opts.Token)
+	self.Sign(offer)
 	_, err = conn.Write(offer.ToBytes())
 	if err != nil {
 		return wrapErr("failed to send file offer", err)
@@ -61,184 +115,710 @@ func sendFile(node *Node, peer Peer, filePath string) error {
 		return wrapErr("invalid response", err)
 	}
 
+	peer, verified := responsePeer(node, peer, response)
+	sender := EventPeer{Name: self.Name, ID: self.ID, Addr: conn.LocalAddr().String()}
+	receiver := EventPeer{Name: peer.Name, ID: peer.ID, Addr: conn.RemoteAddr().String()}
 	// Create send event with empty result
-	absFilePath, err := filepath.Abs(filePath)
-	if err != nil {
-		return wrapErr("failed to get absolute file path", err)
+	event := newEvent(actionSend, filePath, fileSize, sender, receiver)
+	event.ModTime, event.Stream = modTime, offer.Stream
+	if offer.Type == treeOfferType {
+		event.Links, event.EmptyDirs = opts.Links, opts.EmptyDirs
 	}
-	event := Event{clock.DateTimeNow(), "send", "", absFilePath, size, node.Name, peer.Name}
+
+	event.Reason, event.Note = response.Reason, response.Note
 
 	// Check if responseType is 'accept'
 	switch response.Type {
 	case acceptType:
-		fmt.Printf("Peer accepted. Sending %q...\n", fileName)
+		if verified {
+			saveContact(node, peer.ID, peer.Name, peer.Addr, peer.PubKey)
+		}
+		event.SavedAs = response.SavedAs
+		if response.SavedAs != "" && response.SavedAs != fileName {
+			fmt.Printf("Peer accepted, saving as %q. Sending %q...\n", sanitizeText(response.SavedAs), fileName)
+		} else {
+			fmt.Printf("Peer accepted. Sending %q...\n", fileName)
+		}
 	case rejectType:
-		addLog(node, event, rejectType)
-		fmt.Println("Peer rejected the file transfer.")
+		err = response.ReasonError()
+		addLog(node, event, resultReject, err)
+		if err != nil {
+			fmt.Println("Peer rejected the file transfer:", err)
+		} else {
+			fmt.Println("Peer rejected the file transfer.")
+		}
 		return nil
 	default:
-		addLog(node, event, "invalid")
-		return fmt.Errorf("invalid response from peer: %s", response.Type)
+		err = fmt.Errorf("invalid response from peer: %s", response.Type)
+		addLog(node, event, resultInvalid, err)
+		return err
 	}
 
 	// Send file data with progress bar
-	bar := newProgressBar(fileSize, "Sending")
+	var dest io.Writer = conn
+	var frames *frameWriter
+	if offer.Stream {
+		frames = newFrameWriter(conn)
+		dest = frames
+	}
+	// Stream receiver sends its final status after the end of stream, or earlier if it aborts the stream
+	var status chan *TransferMessage
+	if offer.Stream {
+		status = make(chan *TransferMessage, 1)
+		go readStreamStatus(reader, status)
+	}
+	bar := newProgressBar(lang.Ternary(offer.Stream, -1, int64(fileSize)), "Sending")
+	progress := node.Events.StartProgress(event)
+	defer progress.Done()
 	buf := make([]byte, chunkSize)
-	for {
-		n, err := file.Read(buf)
+	checksum := sha256.New()
+	start := time.Now()
+	var sent uint64
+	var final *TransferMessage // final status of stream receiver
+	hasStatus := false
+	for !hasStatus {
+		n, err := source.Read(buf)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			addLog(node, event, "fail")
+			addLog(node, event, resultFail, err)
 			return wrapErr("failed to read file", err)
 		}
 
-		_, err = conn.Write(buf[:n])
+		_, err = dest.Write(buf[:n])
+		if err != nil && frames != nil {
+			// Connection may be closed by receiver aborting the stream: check its status
+			final, hasStatus = <-status, true
+			break
+		}
 		if err != nil {
-			addLog(node, event, "fail")
+			addLog(node, event, resultFail, err)
 			return wrapErr("failed to send data", err)
 		}
+		checksum.Write(buf[:n])
+		sent += uint64(n)
 		bar.Add(n)
+		progress.Add(n)
+		select {
+		case final = <-status:
+			hasStatus = true
+		default:
+		}
+	}
+	if frames != nil {
+		event.Size = sent
+		if !hasStatus {
+			if err := frames.Close(); err != nil {
+				addLog(node, event, resultFail, err)
+				return wrapErr("failed to send data", err)
+			}
+			final = <-status
+		}
+		if err := streamResult(final); err != nil {
+			event.SetStats(start, sent, checksum)
+			addLog(node, event, resultFail, err)
+			fmt.Println("\nPeer did not save the stream:", err)
+			return err
+		}
 	}
 
-	addLog(node, event, "ok")
+	event.SetStats(start, sent, checksum)
+	addLog(node, event, resultOK, nil)
 	fmt.Println("\n✓ File sent successfully!")
 	return nil
 }
 
-// Listens for incoming file transfers
-func receiveFiles(node *Node, port uint16, outputDir string, autoAccept, overwrite bool) error {
-	// Listen to port via TCP
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return wrapErr("failed to listen", err)
+// Check final status of stream receiver, returns error if the stream was not saved
+func streamResult(status *TransferMessage) error {
+	switch {
+	case status == nil:
+		return errors.New("connection closed before the receiver confirmed the stream")
+	case status.Type == acceptType:
+		return nil
+	case status.ReasonError() != nil:
+		return status.ReasonError()
 	}
-	defer listener.Close()
+	return errors.New("stream aborted by receiver")
+}
+
+// Listen to transfer port via TCP, trying the next ports if unavailable
+func listenTransfer(port uint16) (net.Listener, uint16, error) {
+	var lastErr error
+	for i := range maxPortFallback {
+		tryPort := int(port) + i
+		if tryPort > math.MaxUint16 {
+			break
+		}
+		addr := fmt.Sprintf("0.0.0.0:%d", tryPort)
+		listener, err := net.Listen("tcp", addr)
+		if err == nil {
+			return listener, uint16(tryPort), nil
+		}
+		lastErr = err
+	}
+	return nil, 0, wrapErr(fmt.Sprintf("failed to listen on ports %d-%d", port, int(port)+maxPortFallback-1), lastErr)
+}
+
+// Only one offer is prompted at a time, as prompts share stdin
+var promptLock sync.Mutex
+
+// Receiver settings for incoming transfers
+type receiveOptions struct {
+	OutputDir  string
+	AutoAccept bool
+	Overwrite  bool
+	NoPerms    bool      // ignore permission bits sent by peer
+	Stdout     io.Writer // write received data here instead of files (open stdout)
+	Inbox      string    // file where received messages are appended
+	MaxSize    uint64    // reject offers larger than this, 0 = no limit
+	PairedOnly bool      // reject offers from senders that are not paired contacts
+	Hidden     bool      // only answer pings with token proof or from paired contacts
+	Token      string    // shared token for hidden mode
+}
 
+// Listens for incoming file transfers
+func receiveFiles(node *Node, listener net.Listener, opts receiveOptions) error {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			continue
 		}
 
-		fmt.Printf("\nIncoming connection from %s...\n", conn.RemoteAddr())
+		if opts.Stdout != nil {
+			// Data is written to stdout: receive one transfer at a time, and stop after the first accepted one
+			accepted, err := handleIncomingTransfer(node, conn, opts)
+			conn.Close()
+			if accepted {
+				return err
+			}
+			if err != nil {
+				fmt.Printf("Transfer error: %v\n", err)
+			}
+			continue
+		}
 
 		go func(c net.Conn) {
 			defer c.Close()
-			if err := handleIncomingTransfer(node, c, outputDir, autoAccept, overwrite); err != nil {
+			if _, err := handleIncomingTransfer(node, c, opts); err != nil {
 				fmt.Printf("Transfer error: %v\n", err)
 			}
 		}(conn)
 	}
 }
 
-// Handle incoming file transfer
-func handleIncomingTransfer(node *Node, conn net.Conn, outputDir string, autoAccept, overwrite bool) error {
+// Handle incoming file transfer, returns true if transfer was accepted
+func handleIncomingTransfer(node *Node, conn net.Conn, opts receiveOptions) (bool, error) {
 	reader := bufio.NewReader(conn)
+	self := node.Identity()
 
 	// Read file offer
 	offerLine, err := reader.ReadString('\n')
 	if err != nil {
-		return wrapErr("failed to read offer", err)
+		return false, wrapErr("failed to read offer", err)
 	}
 	offerLine = strings.TrimSpace(offerLine)
 
 	offer, err := parseMessage[TransferMessage]([]byte(offerLine))
 	if err != nil {
-		return wrapErr("invalid offer", err)
+		return false, wrapErr("invalid offer", err)
+	}
+
+	if offer.Type == pingType {
+		if opts.Hidden && (offer.Query == nil || !canQueryHidden(offer.Query, opts.Token, node.KnownContacts())) {
+			return false, nil // hidden: ignore ping, like discovery queries
+		}
+		// Respond to ping with our full announce, and echo the query in the signed pong (proves it is not replayed)
+		transferPort := uint16(conn.LocalAddr().(*net.TCPAddr).Port)
+		pong := newPongMessage(nodeAnnounce(node, transferPort))
+		pong.Query = offer.Query
+		self.Sign(pong)
+		_, err = conn.Write(pong.ToBytes())
+		return false, err
+	}
+
+	if opts.Hidden && !canOfferHidden(offer, opts.Token, node.KnownContacts()) {
+		// Hidden: close without reply, so the node's identity is not revealed
+		fmt.Printf("\nIgnored %s from %s: not a paired contact and no token (hidden)\n", offer.Type, conn.RemoteAddr())
+		return false, nil
 	}
 
-	if offer.Type != offerType {
-		return fmt.Errorf("expected file offer, got %s", offer.Type)
+	if offer.Type == textType {
+		return false, receiveText(node, conn, offer, opts)
+	}
+
+	fmt.Printf("\nIncoming connection from %s...\n", conn.RemoteAddr())
+
+	if offer.Type != offerType && offer.Type != treeOfferType {
+		return false, fmt.Errorf("expected file offer, got %s", offer.Type)
+	}
+	// File name comes from the peer: validate it before building any path with it
+	isTree := offer.Type == treeOfferType
+	switch {
+	case !isFileName(offer.Filename):
+		err = fmt.Errorf("invalid file name %q", sanitizeText(offer.Filename))
+	case isTree && opts.Stdout != nil:
+		err = fmt.Errorf("cannot write folder %q to stdout", offer.Filename)
+	case isTree:
+		err = validateTree(offer.Entries, offer.Size)
+	}
+	if err != nil {
+		msg := newRejectMessage(self.ID, self.Name)
+		msg.Reason, msg.Note = reasonInvalid, err.Error()
+		self.Sign(msg)
+		conn.Write(msg.ToBytes())
+		return false, wrapErr("invalid offer", err)
 	}
 
 	fileName, fileSize := offer.Filename, offer.Size
-	size := fmt.Sprintf("%d", fileSize)
+	description := fmt.Sprintf("file %q (%s)", fileName, computeFileSize(fileSize))
+	if offer.Stream {
+		description = fmt.Sprintf("stream %q (size unknown)", fileName)
+	} else if isTree {
+		description = fmt.Sprintf("folder %q (%d files, %s)", fileName, countFiles(offer.Entries), computeFileSize(fileSize))
+	}
 
-	var msg *TransferMessage
-	rejected := false
-	if autoAccept {
-		msg = newAcceptMessage()
-	} else {
-		// Prompt confirmation
-		fmt.Printf("Incoming file %q (%s) from %q. Accept? [Type 'N' to reject]: ", fileName, computeFileSize(fileSize), offer.Sender)
-		switch readInput() {
-		case "N", "n":
-			msg = newRejectMessage()
-			rejected = true
-		default:
-			msg = newAcceptMessage()
+	outputPath := stdoutPrefix + fileName
+	if opts.Stdout == nil {
+		outputPath = filepath.Join(opts.OutputDir, fileName)
+		if !opts.Overwrite {
+			outputPath = getOutputPath(outputPath)
 		}
 	}
-	_, err = conn.Write(msg.ToBytes())
-	if err != nil {
-		return wrapErr("failed to send response", err)
+
+	// Reject if sender is not paired (paired mode), or if offer does not fit.
+	// Otherwise, accept automatically or prompt user (one offer at a time, as prompts share stdin)
+	accepted, note := false, ""
+	reason, rejectErr := checkOfferSender(node, offer, opts)
+	if reason == "" {
+		reason, rejectErr = checkOfferSize(offer, opts)
 	}
-	outputPath := filepath.Join(outputDir, fileName)
-	if !overwrite {
-		outputPath = getOutputPath(outputPath)
+	switch {
+	case reason != "":
+		fmt.Printf("Incoming %s from %s. Rejected: %v\n", description, senderLabel(node, offer), rejectErr)
+	case opts.AutoAccept:
+		accepted, reason = true, reasonAuto
+	case !promptLock.TryLock():
+		reason, rejectErr = reasonBusy, fmt.Errorf("busy with another offer")
+		fmt.Printf("Incoming %s from %s. Rejected: %v\n", description, senderLabel(node, offer), rejectErr)
+	default:
+		fmt.Printf("Incoming %s from %s.\n", description, senderLabel(node, offer))
+		var path string
+		accepted, path, note = promptOffer(fileName, opts)
+		promptLock.Unlock()
+		if accepted {
+			reason, outputPath = reasonUser, path
+		} else {
+			reason = reasonDeclined
+			rejectErr = errors.New(describeReason(reason, note))
+		}
 	}
 
-	// Create receive event with empty result
-	absOutputPath, err := filepath.Abs(outputPath)
+	eventPath, savedAs := outputPath, ""
+	if opts.Stdout == nil {
+		if eventPath, err = filepath.Abs(outputPath); err != nil {
+			return false, wrapErr("failed to get absolute file path", err)
+		}
+		savedAs = savedName(opts.OutputDir, outputPath)
+	}
+	msg := newRejectMessage(self.ID, self.Name)
+	if accepted {
+		msg = newAcceptMessage(self.ID, self.Name)
+		msg.SavedAs = savedAs
+	}
+	msg.Reason, msg.Note = reason, note
+	// Signed, so the sender can verify the receiver before saving it as contact
+	self.Sign(msg)
+	_, err = conn.Write(msg.ToBytes())
 	if err != nil {
-		return wrapErr("failed to get absolute file path", err)
+		return false, wrapErr("failed to send response", err)
 	}
-	event := Event{clock.DateTimeNow(), "receive", "", absOutputPath, size, offer.Sender, node.Name}
 
-	if rejected {
-		addLog(node, event, rejectType)
+	// Create receive event with empty result
+	sender := EventPeer{Name: offer.Sender, ID: offer.SenderID, Addr: conn.RemoteAddr().String()}
+	receiver := EventPeer{Name: self.Name, ID: self.ID, Addr: conn.LocalAddr().String()}
+	event := newEvent(actionReceive, eventPath, fileSize, sender, receiver)
+	event.Stream, event.Reason, event.Note, event.SavedAs = offer.Stream, reason, note, msg.SavedAs
+
+	if !accepted {
+		addLog(node, event, resultReject, rejectErr)
 		fmt.Println("Rejected file transfer.")
-		return nil
+		return false, nil
+	}
+	if offer.Verify() {
+		// Unverified senders could claim any name, so only verified senders are saved
+		saveContact(node, offer.SenderID, offer.Sender, "", offer.PubKey)
 	}
 
-	// Receive file data
-	fmt.Printf("Receiving %q (%d bytes)...\n", fileName, fileSize)
-	file, err := os.Create(outputPath)
+	// Receive file data: into file, into files of folder in entry order, or to stdout
+	fmt.Printf("Receiving %q (%s)...\n", fileName, lang.Ternary(offer.Stream, "size unknown", fmt.Sprintf("%d bytes", fileSize)))
+	if opts.Stdout == nil {
+		// Chosen subfolder may not exist yet
+		if err = os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+			addLog(node, event, resultFail, err)
+			return true, wrapErr("failed to create folder", err)
+		}
+	}
+	var dest io.WriteCloser
+	var tree *treeWriter
+	if opts.Stdout != nil {
+		dest = nopWriteCloser{opts.Stdout}
+	} else if isTree {
+		tree, err = newTreeWriter(outputPath, offer.Entries, opts.NoPerms)
+		dest = tree
+	} else {
+		dest, err = os.Create(outputPath)
+	}
 	if err != nil {
-		addLog(node, event, "fail")
-		return wrapErr("failed to create file", err)
+		addLog(node, event, resultFail, err)
+		return true, wrapErr("failed to create file", err)
 	}
-	defer file.Close()
+	defer dest.Close()
 
-	bar := newProgressBar(fileSize, "Receiving")
+	// Stream data is read from frames, until end of stream
+	var source io.Reader = reader
+	if offer.Stream {
+		source = newFrameReader(reader)
+	}
+	bar := newProgressBar(lang.Ternary(offer.Stream, -1, int64(fileSize)), "Receiving")
+	progress := node.Events.StartProgress(event)
+	defer progress.Done()
 	buf := make([]byte, chunkSize)
+	checksum := sha256.New()
+	start := time.Now()
 	var received uint64
 
-	for received < fileSize {
+	for offer.Stream || received < fileSize {
 		toRead := chunkSize
-		if remaining := fileSize - received; remaining < uint64(toRead) {
+		if remaining := fileSize - received; !offer.Stream && remaining < uint64(toRead) {
 			toRead = int(remaining)
 		}
 
-		n, err := reader.Read(buf[:toRead])
+		n, err := source.Read(buf[:toRead])
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			addLog(node, event, "fail")
-			return wrapErr("failed to read data", err)
+			addLog(node, event, resultFail, err)
+			return true, wrapErr("failed to read data", err)
 		}
 
-		_, err = file.Write(buf[:n])
+		_, err = dest.Write(buf[:n])
 		if err != nil {
-			addLog(node, event, "fail")
-			return wrapErr("failed to write file", err)
+			addLog(node, event, resultFail, err)
+			if offer.Stream {
+				progress.Done()
+				abortStream(conn, reader, self, reasonFailed, "")
+			}
+			return true, wrapErr("failed to write file", err)
 		}
 
+		checksum.Write(buf[:n])
 		received += uint64(n)
 		bar.Add(n)
+		progress.Add(n)
+		if !offer.Stream {
+			continue
+		}
+		if reason, err := checkStreamSize(received, uint64(n), filepath.Dir(outputPath), opts); err != nil {
+			if opts.Stdout == nil {
+				dest.Close()
+				os.Remove(outputPath) // remove partial file
+			}
+			addLog(node, event, resultFail, err)
+			progress.Done()
+			abortStream(conn, reader, self, reason, err.Error())
+			return true, err
+		}
 	}
 
-	addLog(node, event, "ok")
+	if offer.Stream {
+		event.Size = received
+	}
+	event.SetStats(start, received, checksum)
+	if received < fileSize {
+		err = fmt.Errorf("connection closed after %d of %d bytes", received, fileSize)
+		addLog(node, event, resultFail, err)
+		return true, err
+	}
+	err = dest.Close()
+	if err == nil && tree != nil {
+		err = tree.Finish()
+	}
+	if err != nil {
+		addLog(node, event, resultFail, err)
+		if offer.Stream {
+			endStream(conn, self, reasonFailed, "")
+		}
+		return true, wrapErr("failed to write file", err)
+	}
+	if offer.Stream {
+		// Stream is saved: confirm to sender, which only logs the stream as sent after this
+		endStream(conn, self, "", "")
+	}
+	if opts.Stdout != nil {
+		addLog(node, event, resultOK, nil)
+		fmt.Println("\n✓ Written to stdout")
+		return true, nil
+	}
+	if err = restoreMetadata(outputPath, offer.Mode, offer.ModTime, opts.NoPerms); err != nil {
+		fmt.Printf("\nWarning: %v\n", err)
+	}
+	if offer.ModTime != 0 {
+		event.ModTime = time.Unix(0, offer.ModTime)
+	}
+	addLog(node, event, resultOK, nil)
 	fmt.Printf("\n✓ Saved to %q\n", outputPath)
+	return true, nil
+}
+
+// Check if offer sender can send (in paired mode, only paired contacts can send).
+// Returns reject reason and error if not
+func checkOfferSender(node *Node, offer *TransferMessage, opts receiveOptions) (string, error) {
+	if !opts.PairedOnly {
+		return "", nil
+	}
+	contact, ok := node.KnownContacts()[offer.SenderID]
+	if ok && contact.Key != "" && contact.Key == offer.PubKey && offer.Verify() {
+		return "", nil
+	}
+	return reasonNotPaired, fmt.Errorf("sender is not a paired contact")
+}
+
+// Check offer against max size, and free space of output folder.
+// Returns reject reason and error if offer does not fit
+func checkOfferSize(offer *TransferMessage, opts receiveOptions) (string, error) {
+	if opts.MaxSize > 0 && offer.Size > opts.MaxSize {
+		return reasonTooLarge, fmt.Errorf("size %s is larger than max size %s", computeFileSize(offer.Size), computeFileSize(opts.MaxSize))
+	}
+	if offer.Stream || opts.Stdout != nil {
+		return "", nil // size unknown, or not saved to disk
+	}
+	// Output folder may not exist yet (created on first save), so check the disk of its nearest existing parent
+	free, err := freeSpace(existingParent(opts.OutputDir))
+	if err != nil {
+		fmt.Printf("Warning: cannot check free space of %q: %v\n", opts.OutputDir, err)
+		return "", nil
+	}
+	if offer.Size > free {
+		return reasonNoSpace, fmt.Errorf("insufficient space: %s needed, %s free", computeFileSize(offer.Size), computeFileSize(free))
+	}
+	return "", nil
+}
+
+// Free space of output folder is re-checked after every interval of received stream data
+const spaceCheckInterval uint64 = 8 * 1024 * 1024
+
+// Check received stream data against max size, and periodically against free space of output folder,
+// as the stream size is not known upfront. Returns reject reason and error if the stream does not fit
+func checkStreamSize(received, chunk uint64, dir string, opts receiveOptions) (string, error) {
+	if opts.MaxSize > 0 && received > opts.MaxSize {
+		return reasonTooLarge, fmt.Errorf("stream is larger than max size %s", computeFileSize(opts.MaxSize))
+	}
+	if opts.Stdout != nil || received/spaceCheckInterval == (received-chunk)/spaceCheckInterval {
+		return "", nil // not saved to disk, or next check not reached yet
+	}
+	// Stop while there is still room for one more interval, instead of filling up the disk
+	free, err := freeSpace(dir)
+	if err != nil || free >= spaceCheckInterval {
+		return "", nil
+	}
+	return reasonNoSpace, fmt.Errorf("insufficient space: %s free after receiving %s", computeFileSize(free), computeFileSize(received))
+}
+
+// Prompt user to accept or reject offer, and choose where to save it: rename, save in subfolder
+// of output folder, and overwrite or keep both if the name already exists.
+// Returns if accepted, the chosen output path, and the reject note
+func promptOffer(fileName string, opts receiveOptions) (bool, string, string) {
+	if opts.Stdout != nil {
+		fmt.Print("Accept? [Type 'N' to reject, or 'N {NOTE}' to reject with a note]: ")
+		command, text, _ := strings.Cut(readInput(), " ")
+		if strings.ToUpper(command) == "N" {
+			return false, "", strings.TrimSpace(text)
+		}
+		return true, stdoutPrefix + fileName, ""
+	}
+
+	folder, name := opts.OutputDir, fileName
+	choices := "'N {NOTE}' to reject, 'R {NAME}' to rename, 'D {FOLDER}' to save in subfolder"
+	for {
+		path := filepath.Join(folder, name)
+		keepPath := getOutputPath(path)
+		exists := keepPath != path
+		switch {
+		case !exists:
+			fmt.Printf("Save as %q? [Enter to accept, %s]: ", savedName(opts.OutputDir, path), choices)
+		case opts.Overwrite:
+			fmt.Printf("%q already exists. Overwrite? [Enter to overwrite, 'K' to keep both, %s]: ", savedName(opts.OutputDir, path), choices)
+		default:
+			fmt.Printf("%q already exists. Save as %q? [Enter to keep both, 'O' to overwrite, %s]: ", savedName(opts.OutputDir, path), savedName(opts.OutputDir, keepPath), choices)
+		}
+
+		command, arg, _ := strings.Cut(readInput(), " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToUpper(command) {
+		case "", "Y", "YES":
+			return true, lang.Ternary(exists && !opts.Overwrite, keepPath, path), ""
+		case "K":
+			return true, keepPath, ""
+		case "O":
+			return true, path, ""
+		case "N":
+			return false, "", arg
+		case "R":
+			if !isFileName(arg) {
+				fmt.Printf("Invalid file name %q\n", arg)
+				continue
+			}
+			name = arg
+		case "D":
+			subfolder, err := subfolderPath(opts.OutputDir, arg)
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			folder = subfolder
+		default:
+			fmt.Printf("Invalid choice %q\n", command)
+		}
+	}
+}
+
+// Get path of subfolder of output folder, which must stay inside the
+// output folder even if some of its existing folders are symlinks
+func subfolderPath(outputDir, subfolder string) (string, error) {
+	if subfolder == "" || !filepath.IsLocal(subfolder) {
+		return "", fmt.Errorf("folder %q is not inside the output folder", subfolder)
+	}
+	path := filepath.Join(outputDir, subfolder)
+	root, err := filepath.EvalSymlinks(outputDir)
+	if err != nil {
+		return path, nil // output folder is created on receive
+	}
+	// Check real path of nearest existing folder
+	for existing := path; isInsideDir(outputDir, existing); existing = filepath.Dir(existing) {
+		real, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			continue
+		}
+		if !isInsideDir(root, real) {
+			return "", fmt.Errorf("folder %q is outside the output folder", subfolder)
+		}
+		break
+	}
+	return path, nil
+}
+
+// Check if name is a plain file name: not empty, local, and without path separators
+func isFileName(name string) bool {
+	return name != "" && name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// Name of saved file, relative to output folder (slash-separated)
+func savedName(outputDir, path string) string {
+	rel, err := filepath.Rel(outputDir, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Restore file permissions and modification time sent by peer
+func restoreMetadata(path string, mode uint32, modTime int64, noPerms bool) error {
+	if mode != 0 && !noPerms {
+		if err := os.Chmod(path, fs.FileMode(mode).Perm()); err != nil {
+			return wrapErr("failed to set file permissions", err)
+		}
+	}
+	if modTime != 0 {
+		if err := os.Chtimes(path, time.Now(), time.Unix(0, modTime)); err != nil {
+			return wrapErr("failed to set modification time", err)
+		}
+	}
 	return nil
 }
 
-func addLog(node *Node, event Event, result string) {
-	event[evResult] = result
-	node.Config.AddLog(event)
-	node.Config.Save()
+// Ping peer's transfer port with signed query (needed by hidden peers), returns pong with peer's full announce if reachable
+func pingPeer(addr string, query *DiscoveryMessage, timeout time.Duration) (*TransferMessage, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, wrapErr("failed to connect", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = conn.Write(newPingMessage(query).ToBytes())
+	if err != nil {
+		return nil, wrapErr("failed to send ping", err)
+	}
+
+	responseLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, wrapErr("failed to read response", err)
+	}
+
+	response, err := parseMessage[TransferMessage]([]byte(strings.TrimSpace(responseLine)))
+	if err != nil || response.Type != pongType || response.Announce == nil {
+		return nil, fmt.Errorf("invalid ping response")
+	}
+	return response, nil
+}
+
+// Describe offer sender, with ID and warning if name belongs to other contacts
+func senderLabel(node *Node, offer *TransferMessage) string {
+	if offer.SenderID == "" {
+		return fmt.Sprintf("%q (no ID)", offer.Sender)
+	}
+	label := fmt.Sprintf("%q [%s, %s]", offer.Sender, offer.SenderID, lang.Ternary(offer.Verify(), statusVerified, "unverified"))
+	others := list.Filter(node.ContactIDs(offer.Sender), func(id string) bool {
+		return id != offer.SenderID
+	})
+	if len(others) > 0 {
+		label += str.Red(fmt.Sprintf(" (name collision with %s)", strings.Join(others, ", ")))
+	}
+	return label
+}
+
+// Use receiver's identity from response, if available. Returns true if the response is signed with the
+// receiver's known key (verified at discovery, or of a paired contact): unsigned responses could claim any name
+func responsePeer(node *Node, peer Peer, response *TransferMessage) (Peer, bool) {
+	if response.SenderID == "" {
+		return peer, false
+	}
+	key := peer.PubKey
+	if response.SenderID != peer.ID {
+		key = "" // key was verified for another ID
+	}
+	if key == "" {
+		key = node.KnownContacts()[response.SenderID].Key
+	}
+	verified := key != "" && response.PubKey == key && response.Verify()
+	peer.ID, peer.Name = response.SenderID, response.Sender
+	peer.PubKey = lang.Ternary(verified, key, "")
+	return peer, verified
+}
+
+// Add or update contact info of peer, and save config
+func saveContact(node *Node, id, name, addr, key string) {
+	err := node.Update(func(cfg *Config) error {
+		cfg.AddContact(id, name, addr, key)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to save contact:", err)
+	}
+}
+
+// Set event result and error, and append to event log
+func addLog(node *Node, event Event, result EventResult, err error) {
+	event.Result = result
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if err := node.Events.Append(event); err != nil {
+		fmt.Println("Failed to save log:", err)
+	}
 }
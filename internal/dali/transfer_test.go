@@ -0,0 +1,242 @@
+package dali
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Send offer to receiving node over an in-memory connection, and return its response
+func offerTransfer(t *testing.T, node *Node, opts receiveOptions, offer *TransferMessage) *TransferMessage {
+	t.Helper()
+	response, err := sendOffer(node, opts, offer)
+	if err != nil {
+		t.Fatalf("failed to get response: %v", err)
+	}
+	return response
+}
+
+// Send offer to receiving node over an in-memory connection, returns error if there is no response
+func sendOffer(node *Node, opts receiveOptions, offer *TransferMessage) (*TransferMessage, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		handleIncomingTransfer(node, server, opts)
+	}()
+	if _, err := client.Write(offer.ToBytes()); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(client).ReadString('\n')
+	client.Close()
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	return parseMessage[TransferMessage]([]byte(strings.TrimSpace(line)))
+}
+
+func TestRejectTraversalName(t *testing.T) {
+	node := newTestNode(t)
+	dir := t.TempDir()
+	opts := receiveOptions{OutputDir: filepath.Join(dir, "out", "files"), AutoAccept: true}
+
+	stream := newOfferMessage("abc", "mallory", "../../evil", 0)
+	stream.Stream = true
+	tree := newOfferMessage("abc", "mallory", "..", 0)
+	tree.Type = treeOfferType
+	tests := map[string]*TransferMessage{
+		"file":       newOfferMessage("abc", "mallory", "../evil", 5),
+		"stream":     stream,
+		"tree root":  tree,
+		"absolute":   newOfferMessage("abc", "mallory", filepath.Join(dir, "evil"), 5),
+		"backslash":  newOfferMessage("abc", "mallory", `..\evil`, 5),
+		"empty":      newOfferMessage("abc", "mallory", "", 5),
+		"dot":        newOfferMessage("abc", "mallory", ".", 5),
+		"subfolder":  newOfferMessage("abc", "mallory", "a/evil", 5),
+		"parent dir": newOfferMessage("abc", "mallory", "a/../../evil", 5),
+	}
+	for name, offer := range tests {
+		t.Run(name, func(t *testing.T) {
+			response := offerTransfer(t, node, opts, offer)
+			if response.Type != rejectType || response.Reason != reasonInvalid {
+				t.Fatalf("expected invalid reject, got %s (%s)", response.Type, response.Reason)
+			}
+		})
+	}
+	for _, path := range []string{filepath.Join(dir, "evil"), filepath.Join(dir, "out", "evil"), filepath.Join(dir, "out")} {
+		if _, err := os.Stat(path); err == nil {
+			t.Fatalf("%s was created", path)
+		}
+	}
+}
+
+func TestIsFileName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"file.txt": true,
+		"..file":   true,
+		"":         false,
+		".":        false,
+		"..":       false,
+		"../a":     false,
+		"a/b":      false,
+		`a\b`:      false,
+		"/a":       false,
+	} {
+		if got := isFileName(name); got != want {
+			t.Errorf("isFileName(%q): expected %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestHiddenIgnoresUnknownSender(t *testing.T) {
+	node, bob := newTestNode(t), newTestNode(t)
+	bobKey, err := bob.SigningKey()
+	if err != nil {
+		t.Fatalf("failed to get signing key: %v", err)
+	}
+	saveContact(node, bob.ID, "bob", "", encodePublicKey(bobKey))
+	opts := receiveOptions{OutputDir: t.TempDir(), Hidden: true, Token: "secret", PairedOnly: true}
+
+	// Unknown sender, without token: no response, so the node's identity is not revealed
+	tree := newOfferMessage("abc", "mallory", "x", 5)
+	tree.Type = treeOfferType
+	if response, err := sendOffer(node, opts, tree); err == nil {
+		t.Fatalf("expected no response, got %s from %s (%s)", response.Type, response.Sender, response.SenderID)
+	}
+	wrongToken := newTextMessage("abc", "mallory", "hi")
+	wrongToken.Query = nodeQuery(&Node{Config: &Config{ID: "abc"}}, "guess")
+	if response, err := sendOffer(node, opts, wrongToken); err == nil {
+		t.Fatalf("expected no response, got %s from %s (%s)", response.Type, response.Sender, response.SenderID)
+	}
+
+	// Token holder and paired contact get a response
+	withToken := newTextMessage("abc", "carol", "hi")
+	withToken.Query = nodeQuery(&Node{Config: &Config{ID: "abc"}}, "secret")
+	paired := newTextMessage(bob.ID, "bob", "hi")
+	paired.Query = nodeQuery(bob, "")
+	paired.Sign(bobKey)
+	for name, msg := range map[string]*TransferMessage{"token": withToken, "paired": paired} {
+		response, err := sendOffer(node, opts, msg)
+		if err != nil {
+			t.Fatalf("%s: expected response, got %v", name, err)
+		}
+		if response.SenderID != node.ID {
+			t.Fatalf("%s: unexpected response %s from %s", name, response.Type, response.SenderID)
+		}
+	}
+}
+
+func TestResponsePeer(t *testing.T) {
+	node, alice, mallory := newTestNode(t), newTestNode(t), newTestNode(t)
+	self := alice.Identity()
+	aliceKey, _ := self.SigningKey()
+
+	// Responses of receiver are signed
+	response := offerTransfer(t, alice, receiveOptions{OutputDir: t.TempDir()}, newTextMessage(node.ID, node.Name, "hi"))
+	if response.Type != acceptType || !response.Verify() {
+		t.Fatalf("expected signed accept, got %s (signed=%v)", response.Type, response.Verify())
+	}
+	unsigned := newAcceptMessage(alice.ID, alice.Name)
+	spoofed := newAcceptMessage(mallory.ID, alice.Name)
+	mallory.Identity().Sign(spoofed)
+
+	discovered := Peer{ID: alice.ID, Name: alice.Name, PubKey: encodePublicKey(aliceKey)}
+	tests := []struct {
+		name     string
+		peer     Peer
+		response *TransferMessage
+		contact  bool
+		verified bool
+	}{
+		{"signed by discovered key", discovered, response, false, true},
+		{"signed by contact key", Peer{}, response, true, true},
+		{"signed, unknown key", Peer{}, response, false, false},
+		{"unsigned", discovered, unsigned, false, false},
+		{"signed by other key", discovered, spoofed, false, false},
+		{"signed by other key, contact name", Peer{}, spoofed, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := newTestNode(t)
+			if test.contact {
+				saveContact(sender, alice.ID, alice.Name, "", encodePublicKey(aliceKey))
+			}
+			peer, verified := responsePeer(sender, test.peer, test.response)
+			if verified != test.verified {
+				t.Fatalf("expected verified=%v, got %v", test.verified, verified)
+			}
+			if peer.ID != test.response.SenderID || verified != (peer.PubKey != "") {
+				t.Fatalf("unexpected peer %+v", peer)
+			}
+		})
+	}
+}
+
+func TestStreamStatus(t *testing.T) {
+	receiver, sender := newTestNode(t), newTestNode(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	dir := t.TempDir()
+	go receiveFiles(receiver, listener, receiveOptions{OutputDir: dir, AutoAccept: true, MaxSize: 256 * 1024})
+
+	defer func(reader *bufio.Reader) { inputReader = reader }(inputReader)
+	peer := Peer{Addr: listener.Addr().String()}
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"within max size", 1000, true},
+		{"larger than max size", 4 * 1024 * 1024, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inputReader = bufio.NewReader(strings.NewReader(strings.Repeat("x", test.size)))
+			err := sendFile(sender, peer, "", sendOptions{Stdin: true, Name: test.name + ".txt"})
+			if (err == nil) != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, err)
+			}
+			events, err := sender.Events.ReadAll()
+			if err != nil || len(events) == 0 {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if result := events[len(events)-1].Result; (result == resultOK) != test.ok {
+				t.Fatalf("expected ok=%v, got result %s", test.ok, result)
+			}
+		})
+	}
+}
+
+func TestCheckStreamSize(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		received uint64
+		opts     receiveOptions
+		reason   string
+	}{
+		{"within max size", 1000, receiveOptions{MaxSize: 1000}, ""},
+		{"larger than max size", 1001, receiveOptions{MaxSize: 1000}, reasonTooLarge},
+		{"larger than max size, stdout", 1001, receiveOptions{MaxSize: 1000, Stdout: io.Discard}, reasonTooLarge},
+		{"free space checked", spaceCheckInterval, receiveOptions{}, ""},
+		{"no limit", 10 * spaceCheckInterval, receiveOptions{Stdout: io.Discard}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, err := checkStreamSize(test.received, 100, dir, test.opts)
+			if reason != test.reason || (err != nil) != (reason != "") {
+				t.Fatalf("expected reason %q, got %q (%v)", test.reason, reason, err)
+			}
+		})
+	}
+}
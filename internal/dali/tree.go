@@ -0,0 +1,423 @@
+package dali
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// Tree entry types
+const (
+	entryFile string = "file"
+	entryDir  string = "dir"
+	entryLink string = "link"
+)
+
+// Symlink policies for sending folders
+const (
+	linksFollow string = "follow" // send the files and folders that links point to
+	linksKeep   string = "keep"   // send links as symlinks
+	linksSkip   string = "skip"   // do not send links
+)
+
+var linkPolicies = []string{linksFollow, linksKeep, linksSkip}
+
+// File, folder or symlink in a folder transfer
+type TreeEntry struct {
+	Path    string // relative path, slash-separated
+	Type    string // file, dir, link
+	Size    uint64 `json:",omitempty"` // file size
+	Mode    uint32 `json:",omitempty"` // permission bits
+	ModTime int64  `json:",omitempty"` // modification time, unix nanoseconds
+	Target  string `json:",omitempty"` // symlink target
+}
+
+// Walk folder and list entries to send: folders come before their contents,
+// and file data is sent in entry order. Returns warnings for skipped entries
+func walkTree(root string, opts sendOptions) ([]TreeEntry, []string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, nil, wrapErr("failed to resolve folder", err)
+	}
+	walker := &treeWalker{opts: opts, entries: make([]TreeEntry, 0), warnings: make([]string, 0)}
+	if err = walker.walk(root, "", []string{realRoot}); err != nil {
+		return nil, nil, err
+	}
+	return walker.entries, walker.warnings, nil
+}
+
+// Collects tree entries of folder
+type treeWalker struct {
+	opts     sendOptions
+	entries  []TreeEntry
+	warnings []string
+}
+
+// Add entries of folder. Ancestors are the real paths of parent folders, for detecting symlink loops
+func (w *treeWalker) walk(dirPath, relPath string, ancestors []string) error {
+	items, err := os.ReadDir(dirPath)
+	if err != nil {
+		return wrapErr("failed to read folder", err)
+	}
+	for _, item := range items {
+		fullPath := filepath.Join(dirPath, item.Name())
+		entryPath := path.Join(relPath, item.Name())
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return wrapErr("failed to get file info", err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			switch w.opts.Links {
+			case linksSkip:
+				continue
+			case linksKeep:
+				target, err := os.Readlink(fullPath)
+				if err != nil {
+					return wrapErr("failed to read symlink", err)
+				}
+				w.entries = append(w.entries, TreeEntry{Path: entryPath, Type: entryLink, Target: filepath.ToSlash(target)})
+				continue
+			}
+			// Follow link
+			if info, err = os.Stat(fullPath); err != nil {
+				w.warnings = append(w.warnings, fmt.Sprintf("skipped broken symlink %q", entryPath))
+				continue
+			}
+		}
+		switch {
+		case info.IsDir():
+			realPath, err := filepath.EvalSymlinks(fullPath)
+			if err != nil {
+				return wrapErr("failed to resolve folder", err)
+			}
+			if slices.Contains(ancestors, realPath) {
+				w.warnings = append(w.warnings, fmt.Sprintf("skipped symlink loop %q", entryPath))
+				continue
+			}
+			index := len(w.entries)
+			w.entries = append(w.entries, newTreeEntry(entryPath, entryDir, info))
+			if err = w.walk(fullPath, entryPath, append(ancestors, realPath)); err != nil {
+				return err
+			}
+			if len(w.entries) == index+1 && !w.opts.EmptyDirs {
+				w.entries = w.entries[:index] // remove empty folder
+			}
+		case info.Mode().IsRegular():
+			w.entries = append(w.entries, newTreeEntry(entryPath, entryFile, info))
+		default:
+			w.warnings = append(w.warnings, fmt.Sprintf("skipped %s %q", fileKind(info.Mode()), entryPath))
+		}
+	}
+	return nil
+}
+
+// Create new TreeEntry from file info
+func newTreeEntry(entryPath, entryType string, info fs.FileInfo) TreeEntry {
+	entry := TreeEntry{
+		Path:    entryPath,
+		Type:    entryType,
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixNano(),
+	}
+	if entryType == entryFile {
+		entry.Size = uint64(info.Size())
+	}
+	return entry
+}
+
+// Describe special file type
+func fileKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "FIFO"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	default:
+		return "special file"
+	}
+}
+
+// Check that tree entries have local paths, known types, and existing parent folders,
+// and that file sizes add up to total size
+func validateTree(entries []TreeEntry, totalSize uint64) error {
+	dirs := map[string]bool{".": true}
+	var size uint64
+	for _, entry := range entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return fmt.Errorf("invalid path %q", entry.Path)
+		}
+		if !dirs[path.Dir(entry.Path)] {
+			return fmt.Errorf("missing folder of %q", entry.Path)
+		}
+		switch entry.Type {
+		case entryDir:
+			dirs[path.Clean(entry.Path)] = true
+		case entryFile:
+			size += entry.Size
+		case entryLink:
+		default:
+			return fmt.Errorf("invalid entry type %q", entry.Type)
+		}
+	}
+	if size != totalSize {
+		return fmt.Errorf("file sizes do not add up to %d bytes", totalSize)
+	}
+	return nil
+}
+
+// Count files in tree entries
+func countFiles(entries []TreeEntry) int {
+	count := 0
+	for _, entry := range entries {
+		if entry.Type == entryFile {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Reads file data of tree entries, in order, as one stream
+type treeReader struct {
+	root      string
+	files     []TreeEntry
+	file      *os.File
+	entry     TreeEntry
+	remaining uint64
+}
+
+// Create new treeReader for files in tree entries
+func newTreeReader(root string, entries []TreeEntry) *treeReader {
+	files := make([]TreeEntry, 0)
+	for _, entry := range entries {
+		if entry.Type == entryFile {
+			files = append(files, entry)
+		}
+	}
+	return &treeReader{root: root, files: files}
+}
+
+// Read file data, failing if a file is shorter than its listed size
+func (r *treeReader) Read(buf []byte) (int, error) {
+	for r.file == nil || r.remaining == 0 {
+		r.Close()
+		if len(r.files) == 0 {
+			return 0, io.EOF
+		}
+		r.entry, r.files = r.files[0], r.files[1:]
+		file, err := os.Open(filepath.Join(r.root, filepath.FromSlash(r.entry.Path)))
+		if err != nil {
+			return 0, err
+		}
+		r.file, r.remaining = file, r.entry.Size
+	}
+	n, err := r.file.Read(buf[:min(uint64(len(buf)), r.remaining)])
+	r.remaining -= uint64(n)
+	if err == io.EOF && r.remaining > 0 {
+		return n, fmt.Errorf("file %q changed during transfer", r.entry.Path)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close current file
+func (r *treeReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Writes stream of file data into tree entries, in order
+type treeWriter struct {
+	root      string
+	realRoot  string
+	entries   []TreeEntry
+	files     []TreeEntry
+	noPerms   bool
+	file      *os.File
+	entry     TreeEntry
+	remaining uint64
+}
+
+// Create root folder and folders of tree entries, and new treeWriter for its files
+func newTreeWriter(root string, entries []TreeEntry, noPerms bool) (*treeWriter, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, wrapErr("failed to create folder", err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, wrapErr("failed to resolve folder", err)
+	}
+	w := &treeWriter{root: root, realRoot: realRoot, entries: entries, files: make([]TreeEntry, 0), noPerms: noPerms}
+	for _, entry := range entries {
+		switch entry.Type {
+		case entryDir:
+			dirPath, err := w.localPath(entry.Path)
+			if err != nil {
+				return nil, err
+			}
+			if err = os.Mkdir(dirPath, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+				return nil, wrapErr("failed to create folder", err)
+			}
+		case entryFile:
+			w.files = append(w.files, entry)
+		}
+	}
+	return w, nil
+}
+
+// Get local path of entry, refusing entries whose folder resolves to outside of root
+func (w *treeWriter) localPath(entryPath string) (string, error) {
+	localPath := filepath.Join(w.root, filepath.FromSlash(entryPath))
+	realDir, err := filepath.EvalSymlinks(filepath.Dir(localPath))
+	if err != nil {
+		return "", wrapErr("failed to resolve folder", err)
+	}
+	if !isInsideDir(w.realRoot, realDir) {
+		return "", fmt.Errorf("refused %q: outside of %s", entryPath, w.root)
+	}
+	return filepath.Join(realDir, filepath.Base(localPath)), nil
+}
+
+// Write file data, moving to the next file when current file is complete
+func (w *treeWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if w.file == nil || w.remaining == 0 {
+			if err := w.nextFile(); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n, err := w.file.Write(data[:min(uint64(len(data)), w.remaining)])
+		written += n
+		w.remaining -= uint64(n)
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// Finish current file, and create the next one
+func (w *treeWriter) nextFile() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if len(w.files) == 0 {
+		return fmt.Errorf("received more data than offered")
+	}
+	w.entry, w.files = w.files[0], w.files[1:]
+	filePath, err := w.localPath(w.entry.Path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return wrapErr("failed to create file", err)
+	}
+	w.file, w.remaining = file, w.entry.Size
+	return nil
+}
+
+// Close current file and restore its metadata
+func (w *treeWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	filePath := w.file.Name()
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return wrapErr("failed to write file", err)
+	}
+	return restoreMetadata(filePath, w.entry.Mode, w.entry.ModTime, w.noPerms)
+}
+
+// Close current file
+func (w *treeWriter) Close() error {
+	return w.closeFile()
+}
+
+// Finish complete transfer: create remaining empty files, symlinks, and restore folder metadata.
+// Symlinks pointing outside of root are refused
+func (w *treeWriter) Finish() error {
+	for len(w.files) > 0 {
+		if err := w.nextFile(); err != nil {
+			return err
+		}
+	}
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	links := make([]string, 0)
+	for _, entry := range w.entries {
+		if entry.Type != entryLink {
+			continue
+		}
+		linkPath, err := w.localPath(entry.Path)
+		if err == nil {
+			err = w.checkLink(linkPath, entry.Target)
+		}
+		if err == nil {
+			err = os.Symlink(filepath.FromSlash(entry.Target), linkPath)
+		}
+		if err != nil {
+			fmt.Printf("\nWarning: skipped symlink %q: %v\n", entry.Path, err)
+			continue
+		}
+		links = append(links, linkPath)
+	}
+	// Check resolved links, in case links pass through other links
+	for _, linkPath := range links {
+		realPath, err := filepath.EvalSymlinks(linkPath)
+		if err == nil && !isInsideDir(w.realRoot, realPath) {
+			os.Remove(linkPath)
+			fmt.Printf("\nWarning: removed symlink %q: points outside of %s\n", linkPath, w.root)
+		}
+	}
+	// Restore folder metadata last (deepest first), as writing contents changes modification time
+	for _, entry := range slices.Backward(w.entries) {
+		if entry.Type != entryDir {
+			continue
+		}
+		dirPath, err := w.localPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		if err = restoreMetadata(dirPath, entry.Mode, entry.ModTime, w.noPerms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that symlink target is relative and inside root
+func (w *treeWriter) checkLink(linkPath, target string) error {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return fmt.Errorf("absolute target %q", target)
+	}
+	if !isInsideDir(w.realRoot, filepath.Join(filepath.Dir(linkPath), target)) {
+		return fmt.Errorf("target %q points outside of %s", target, w.root)
+	}
+	return nil
+}
+
+// Check if path is the folder or inside it
+func isInsideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
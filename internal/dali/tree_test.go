@@ -0,0 +1,155 @@
+package dali
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateTree(t *testing.T) {
+	file := func(path string, size uint64) TreeEntry {
+		return TreeEntry{Path: path, Type: entryFile, Size: size}
+	}
+	dir := func(path string) TreeEntry {
+		return TreeEntry{Path: path, Type: entryDir}
+	}
+	tests := []struct {
+		name    string
+		entries []TreeEntry
+		size    uint64
+		valid   bool
+	}{
+		{"valid", []TreeEntry{dir("a"), file("a/b.txt", 3), file("c.txt", 2), {Path: "a/l", Type: entryLink, Target: "b.txt"}}, 5, true},
+		{"empty", nil, 0, true},
+		{"parent entry", []TreeEntry{file("../evil", 1)}, 1, false},
+		{"dot-dot entry", []TreeEntry{dir("..")}, 0, false},
+		{"escaping entry", []TreeEntry{dir("a"), file("a/../../evil", 1)}, 1, false},
+		{"absolute entry", []TreeEntry{file("/tmp/evil", 1)}, 1, false},
+		{"backslash entry", []TreeEntry{file(`..\evil`, 1)}, 1, filepath.Separator != '\\'}, // plain file name on Unix
+		{"missing folder", []TreeEntry{file("a/b.txt", 1)}, 1, false},
+		{"file under file", []TreeEntry{file("a", 1), file("a/b.txt", 1)}, 2, false},
+		{"folder under link", []TreeEntry{{Path: "l", Type: entryLink, Target: "."}, file("l/b.txt", 1)}, 1, false},
+		{"unknown type", []TreeEntry{{Path: "a", Type: "fifo"}}, 0, false},
+		{"size mismatch", []TreeEntry{file("a", 1)}, 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateTree(test.entries, test.size)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid=%v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestCheckLink(t *testing.T) {
+	root := t.TempDir()
+	w, err := newTreeWriter(root, []TreeEntry{{Path: "sub", Type: entryDir}}, false)
+	if err != nil {
+		t.Fatalf("failed to create tree writer: %v", err)
+	}
+	tests := []struct {
+		name   string
+		link   string
+		target string
+		valid  bool
+	}{
+		{"sibling", "l", "a.txt", true},
+		{"root", "l", ".", true},
+		{"into folder", "l", "sub/a.txt", true},
+		{"parent inside root", "sub/l", "../a.txt", true},
+		{"through folder", "l", "sub/../a.txt", true},
+		{"parent of root", "l", "..", false},
+		{"outside root", "sub/l", "../../evil", false},
+		{"escaping through folder", "l", "sub/../../evil", false},
+		{"absolute", "l", filepath.Join(root, "a.txt"), false},
+		{"absolute slash", "l", "/etc/passwd", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			linkPath, err := w.localPath(test.link)
+			if err != nil {
+				t.Fatalf("failed to get local path: %v", err)
+			}
+			if err = w.checkLink(linkPath, test.target); (err == nil) != test.valid {
+				t.Fatalf("expected valid=%v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestTreeWriterRefusesEscapes(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	// Folder of received tree is a symlink to outside of root (e.g. left by an earlier transfer)
+	if err := os.Symlink(outside, filepath.Join(root, "d")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	entries := []TreeEntry{
+		{Path: "d", Type: entryDir},
+		{Path: "d/evil", Type: entryFile, Size: 4},
+	}
+	w, err := newTreeWriter(root, entries, false)
+	if err != nil {
+		t.Fatalf("failed to create tree writer: %v", err)
+	}
+	if _, err = w.Write([]byte("evil")); err == nil {
+		t.Fatal("expected file under symlinked folder to be refused")
+	}
+	w.Close()
+	if _, err = os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Fatal("file was written outside of root")
+	}
+
+	// Links with absolute or escaping targets are skipped, links inside root are created
+	root = t.TempDir()
+	entries = []TreeEntry{
+		{Path: "a.txt", Type: entryFile, Size: 2},
+		{Path: "ok", Type: entryLink, Target: "a.txt"},
+		{Path: "abs", Type: entryLink, Target: outside},
+		{Path: "up", Type: entryLink, Target: "../" + filepath.Base(outside)},
+		// Link through a link: each target is inside root, but the resolved path is not
+		{Path: "hop", Type: entryLink, Target: "."},
+		{Path: "hop2", Type: entryLink, Target: "hop/.."},
+	}
+	if w, err = newTreeWriter(root, entries, false); err != nil {
+		t.Fatalf("failed to create tree writer: %v", err)
+	}
+	if _, err = w.Write([]byte("ok")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err = w.Finish(); err != nil {
+		t.Fatalf("failed to finish: %v", err)
+	}
+	for name, want := range map[string]bool{"ok": true, "hop": true, "abs": false, "up": false, "hop2": false} {
+		_, err := os.Lstat(filepath.Join(root, name))
+		if (err == nil) != want {
+			t.Errorf("link %s: expected created=%v, got %v", name, want, err)
+		}
+	}
+}
+
+func TestTreeRootName(t *testing.T) {
+	node := newTestNode(t)
+	dir := t.TempDir()
+	opts := receiveOptions{OutputDir: filepath.Join(dir, "out"), AutoAccept: true}
+	for name, valid := range map[string]bool{
+		"photos": true,
+		"..":     false,
+		".":      false,
+		"../up":  false,
+		"a/b":    false,
+		dir:      false,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tree := newOfferMessage("abc", "mallory", name, 0)
+			tree.Type = treeOfferType
+			response := offerTransfer(t, node, opts, tree)
+			if rejected := response.Type == rejectType && response.Reason == reasonInvalid; rejected == valid {
+				t.Fatalf("expected valid=%v, got %s (%s)", valid, response.Type, response.Note)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only output folder in %s, got %d entries", dir, len(entries))
+	}
+}
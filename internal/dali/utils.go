@@ -2,24 +2,31 @@ package dali
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/roidaradal/fn/dict"
 	"github.com/roidaradal/fn/io"
 	"github.com/roidaradal/fn/list"
 	"github.com/roidaradal/fn/number"
+	"github.com/roidaradal/fn/str"
 	"github.com/schollz/progressbar/v3"
 )
 
 // Wildcard default for names and ip addresses
 const anything string = "*"
 
+// Max number of hosts in subnet scan (/20)
+const maxScanHosts int = 4096
+
 // Remove spaces from name
 func compressName(name string) string {
 	return strings.Join(strings.Fields(name), "")
@@ -32,6 +39,11 @@ func maxPeerNameLength(peers []Peer) int {
 	}))
 }
 
+// Split comma-separated list, skipping empty items
+func splitList(text string) []string {
+	return list.Filter(str.CommaSplit(text), str.NotEmpty)
+}
+
 // Wrap error with prefix message
 func wrapErr(message string, err error) error {
 	return fmt.Errorf("%s: %w", message, err)
@@ -44,8 +56,46 @@ func newIPv4(addr string) net.IP {
 	return net.IPv4(a, b, c, d)
 }
 
-// Get local IPv4 address
-func getLocalIPv4Address(soloIP bool) (string, error) {
+// Parse port number, returns false if invalid
+func parsePort(value string) (int, bool) {
+	port := number.ParseInt(value)
+	return port, port > 0 && port <= math.MaxUint16
+}
+
+// Expand IPv4 CIDR range into list of host IP addresses
+func expandCIDR(cidr string) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, wrapErr("invalid CIDR range", err)
+	}
+	start := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if start == nil || bits != 32 {
+		return nil, fmt.Errorf("only IPv4 CIDR ranges are supported")
+	}
+	numHosts := 1 << (bits - ones)
+	if numHosts > maxScanHosts {
+		return nil, fmt.Errorf("CIDR range too large (max %d hosts)", maxScanHosts)
+	}
+
+	base := binary.BigEndian.Uint32(start)
+	first, last := 0, numHosts-1
+	if numHosts > 2 {
+		// Skip network and broadcast addresses
+		first, last = 1, numHosts-2
+	}
+	ips := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i))
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// Get local IPv4 address. If there are multiple networks, network (IP address) is used if set,
+// otherwise user is prompted to select one (unless prompts are disabled)
+func getLocalIPv4Address(soloIP bool, network string, canPrompt bool) (string, error) {
 	host, err := os.Hostname()
 	if err != nil {
 		return "", wrapErr("failed to get hostname", err)
@@ -67,6 +117,13 @@ func getLocalIPv4Address(soloIP bool) (string, error) {
 		return strings.Join(ips, ", "), nil
 	}
 
+	if network != "" {
+		if !slices.Contains(ips, network) {
+			return "", fmt.Errorf("network %s not found, choose from: %s", network, strings.Join(ips, ", "))
+		}
+		return network, nil
+	}
+
 	numIPs := len(ips)
 	switch numIPs {
 	case 0:
@@ -74,6 +131,9 @@ func getLocalIPv4Address(soloIP bool) (string, error) {
 	case 1:
 		return ips[0], nil
 	default:
+		if !canPrompt {
+			return "", fmt.Errorf("found %d networks (%s), use net=<IP> to choose one", numIPs, strings.Join(ips, ", "))
+		}
 		// Display network choices
 		name := getNetworkNames(ips)
 		fmt.Println("\nSelect network:")
@@ -124,14 +184,15 @@ func getNetworkNames(ips []string) dict.StringMap {
 	return name
 }
 
-// Create new progress bar
-func newProgressBar(fileSize uint64, title string) *progressbar.ProgressBar {
+// Create new progress bar, size is -1 if unknown
+func newProgressBar(size int64, title string) *progressbar.ProgressBar {
 	return progressbar.NewOptions64(
-		int64(fileSize),
+		size,
 		progressbar.OptionSetDescription(title),
 		progressbar.OptionSetWidth(40),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionShowCount(),
+		progressbar.OptionSetSpinnerChangeInterval(0), // spin on data only, so spinner of unknown size stops with the transfer
 		progressbar.OptionSetTheme(progressbar.Theme{
 			Saucer:        "█",
 			SaucerHead:    "▓",
@@ -149,6 +210,31 @@ func findingMessage(node *Node) string {
 
 var inputReader = bufio.NewReader(os.Stdin)
 
+// Output for received data (open stdout): the original stdout, as messages are redirected to stderr
+var dataOutput = os.Stdout
+
+// Redirect messages to stderr if stdout is used for received data (open stdout)
+func InitOutput(command string, options dict.StringMap) {
+	if _, ok := options["stdout"]; ok && command == openCmd {
+		os.Stdout = os.Stderr
+	}
+}
+
+// Get nearest existing folder of path: path itself, or its closest existing parent (if not created yet)
+func existingParent(path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	for !io.PathExists(path) {
+		parent := filepath.Dir(path)
+		if parent == path {
+			break // reached root
+		}
+		path = parent
+	}
+	return path
+}
+
 // Read input from stdin
 func readInput() string {
 	input, _ := inputReader.ReadString('\n')
@@ -174,6 +260,90 @@ func computeFileSize(numBytes uint64) string {
 	return fmt.Sprintf("%dB", numBytes)
 }
 
+// Parse file size with optional unit (e.g. 500, 10KB, 1.5MB, 2GB), in bytes
+func parseFileSize(text string) (int64, bool) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	units := []string{"GB", "MB", "KB", "G", "M", "K", "B"}
+	powers := []float64{3, 2, 1, 3, 2, 1, 0}
+	multiplier := 1.0
+	for i, unit := range units {
+		if strings.HasSuffix(text, unit) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit))
+			multiplier = math.Pow(1024, powers[i])
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	return int64(value * multiplier), true
+}
+
+// Parse age: number with unit w (weeks), d (days), or Go duration (e.g. 7d, 2w, 12h, 30m)
+func parseAge(text string) (time.Duration, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	days := map[string]int{"d": 1, "w": 7}
+	for unit, numDays := range days {
+		if value, ok := strings.CutSuffix(text, unit); ok {
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 {
+				return 0, false
+			}
+			return time.Duration(count*numDays) * 24 * time.Hour, true
+		}
+	}
+	age, err := time.ParseDuration(text)
+	if err != nil || age < 0 {
+		return 0, false
+	}
+	return age, true
+}
+
+// Write file atomically: write to temp file in the same folder, fsync, then rename over path
+func writeFileAtomic(path string, data []byte) error {
+	return replaceFile(path, data, true)
+}
+
+// Write to temp file in the same folder, then rename over path, so readers never see a partial file.
+// If durable, the file and the rename are synced to disk
+func replaceFile(path string, data []byte, durable bool) error {
+	folder := filepath.Dir(path)
+	if err := os.MkdirAll(folder, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(folder, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return wrapErr("failed to create temp file", err)
+	}
+	defer os.Remove(file.Name()) // cleanup if rename did not happen
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return wrapErr("failed to write temp file", err)
+	}
+	if durable {
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return wrapErr("failed to sync temp file", err)
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return wrapErr("failed to replace file", err)
+	}
+	if !durable {
+		return nil
+	}
+	// Sync folder so the rename is persisted (not supported on Windows)
+	if dir, err := os.Open(folder); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
 // Find safe output file path (append _1, _2, ... if file already exists)
 func getOutputPath(path string) string {
 	if !io.PathExists(path) {
@@ -0,0 +1,33 @@
+package dali
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExistingParent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0o755); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"existing", filepath.Join(dir, "a"), filepath.Join(dir, "a")},
+		{"missing", filepath.Join(dir, "a", "b"), filepath.Join(dir, "a")},
+		{"missing parents", filepath.Join(dir, "x", "y", "z"), dir},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := existingParent(test.path); got != test.want {
+				t.Fatalf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+	if _, err := freeSpace(existingParent(filepath.Join(dir, "x", "y"))); err != nil {
+		t.Fatalf("free space of missing folder: %v", err)
+	}
+}
@@ -10,8 +10,9 @@ import (
 
 func main() {
 	command, options := io.GetCommandOptions(dali.HelpCmd)
+	dali.InitOutput(command, options)
 
-	node, err := dali.LoadNode(command)
+	node, err := dali.LoadNode(command, options)
 	if err != nil {
 		log.Fatal("Failed to initialize: ", err)
 	}